@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Clever/pathio"
+	"gopkg.in/yaml.v2"
+)
+
+// RegistryEnvVar names the env var holding the path (local or s3://) of a registry file.
+// When it isn't set, clusters are read from env vars named after the cluster.
+const RegistryEnvVar = "MONGO_CLUSTERS"
+
+// Cluster is everything needed to export from one mongo cluster
+type Cluster struct {
+	Name     string
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Config is the YAML config of the tables to export. ConfigPath can be given instead
+	// to read it from a local or s3:// path.
+	Config     string `yaml:"config"`
+	ConfigPath string `yaml:"config_path"`
+	// Options are connection string options added to the url, e.g. readPreference
+	Options map[string]string `yaml:"options"`
+}
+
+// Lookup resolves the named cluster from the registry file in RegistryEnvVar if there is
+// one, or else from env vars. Only the named cluster is resolved, so the env vars of other
+// clusters don't need to be set.
+func Lookup(name string) (Cluster, error) {
+	return LookupWithConfig(name, "")
+}
+
+// LookupWithConfig is Lookup, but if configPath (local or s3://) is set the config is read
+// from it instead, and the cluster doesn't need a config of its own
+func LookupWithConfig(name, configPath string) (Cluster, error) {
+	var c Cluster
+	if path := os.Getenv(RegistryEnvVar); path == "" {
+		var err error
+		if c, err = fromEnv(name, os.Getenv, configPath == ""); err != nil {
+			return Cluster{}, err
+		}
+	} else {
+		data, err := ReadPath(path)
+		if err != nil {
+			return Cluster{}, fmt.Errorf("reading cluster registry %s: %s", path, err)
+		}
+		if c, err = fromRegistry(data, name, os.Getenv, configPath == ""); err != nil {
+			return Cluster{}, err
+		}
+	}
+	if configPath != "" {
+		c.Config, c.ConfigPath = "", configPath
+	}
+	if c.Config == "" {
+		configData, err := ReadPath(c.ConfigPath)
+		if err != nil {
+			return Cluster{}, fmt.Errorf("reading config for cluster %s: %s", name, err)
+		}
+		c.Config = string(configData)
+	}
+	return c, nil
+}
+
+// ReadPath reads the file at a local or s3:// path
+func ReadPath(path string) ([]byte, error) {
+	reader, err := pathio.Reader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// FromEnv resolves a cluster from the env vars <NAME>_URL, <NAME>_USERNAME,
+// <NAME>_PASSWORD, <NAME>_CONFIG and <NAME>_OPTIONS, where NAME is the upper-cased name.
+// URL and CONFIG are required. OPTIONS is a query string, e.g. readPreference=secondary.
+func FromEnv(name string, getenv func(string) string) (Cluster, error) {
+	return fromEnv(name, getenv, true)
+}
+
+func fromEnv(name string, getenv func(string) string, requireConfig bool) (Cluster, error) {
+	prefix := strings.ToUpper(name) + "_"
+	c := Cluster{
+		Name:     name,
+		URL:      getenv(prefix + "URL"),
+		Username: getenv(prefix + "USERNAME"),
+		Password: getenv(prefix + "PASSWORD"),
+		Config:   getenv(prefix + "CONFIG"),
+		Options:  map[string]string{},
+	}
+	if c.URL == "" {
+		return Cluster{}, fmt.Errorf("cluster %s: env variable %sURL is not set", name, prefix)
+	}
+	if c.Config == "" && requireConfig {
+		return Cluster{}, fmt.Errorf("cluster %s: env variable %sCONFIG is not set", name, prefix)
+	}
+	if options := getenv(prefix + "OPTIONS"); options != "" {
+		values, err := url.ParseQuery(options)
+		if err != nil {
+			return Cluster{}, fmt.Errorf("cluster %s: invalid %sOPTIONS: %s", name, prefix, err)
+		}
+		for key := range values {
+			c.Options[key] = values.Get(key)
+		}
+	}
+	return c, nil
+}
+
+// FromRegistry resolves a cluster from a YAML registry keyed by cluster name, e.g.
+//
+//	il:
+//	  url: ${IL_URL}
+//	  username: ${IL_USERNAME}
+//	  password: ${IL_PASSWORD}
+//	  config_path: s3://bucket/il.yml
+//	  options:
+//	    readPreference: secondary
+//
+// ${VAR}s in the url, username and password are expanded from the environment, so secrets
+// don't have to be in the file. The rest is taken as it is, since configs can have $s.
+func FromRegistry(data []byte, name string, getenv func(string) string) (Cluster, error) {
+	return fromRegistry(data, name, getenv, true)
+}
+
+func fromRegistry(data []byte, name string, getenv func(string) string, requireConfig bool) (Cluster, error) {
+	registry := map[string]Cluster{}
+	if err := yaml.Unmarshal(data, &registry); err != nil {
+		return Cluster{}, fmt.Errorf("invalid cluster registry: %s", err)
+	}
+	c, ok := registry[name]
+	if !ok {
+		names := []string{}
+		for n := range registry {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Cluster{}, fmt.Errorf("cluster %s is not in the registry (%s)", name, strings.Join(names, ", "))
+	}
+
+	c.Name = name
+	c.URL = os.Expand(c.URL, getenv)
+	c.Username = os.Expand(c.Username, getenv)
+	c.Password = os.Expand(c.Password, getenv)
+	if c.URL == "" {
+		return Cluster{}, fmt.Errorf("cluster %s has no url", name)
+	}
+	if c.Config == "" && c.ConfigPath == "" && requireConfig {
+		return Cluster{}, fmt.Errorf("cluster %s has neither a config nor a config_path", name)
+	}
+	return c, nil
+}
+
+// ConnectionURL returns the cluster's url with its options added to the query string.
+// Options already in the url are overridden.
+func (c Cluster) ConnectionURL() (string, error) {
+	if len(c.Options) == 0 {
+		return c.URL, nil
+	}
+	// mongo urls can list several hosts, which net/url can't parse, so only the query
+	// string is handled here
+	base, rawQuery := c.URL, ""
+	if i := strings.Index(c.URL, "?"); i >= 0 {
+		base, rawQuery = c.URL[:i], c.URL[i+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", fmt.Errorf("cluster %s has an invalid url query: %s", c.Name, err)
+	}
+	for key, val := range c.Options {
+		query.Set(key, val)
+	}
+	return base + "?" + query.Encode(), nil
+}
@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getenvFrom(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	getenv := getenvFrom(map[string]string{
+		"IL_USER_URL":      "mongodb://host/db",
+		"IL_USER_USERNAME": "user",
+		"IL_USER_PASSWORD": "pass",
+		"IL_USER_CONFIG":   "table: {}",
+		"IL_USER_OPTIONS":  "readPreference=secondary",
+	})
+	c, err := FromEnv("il_user", getenv)
+	assert.NoError(t, err)
+	assert.Equal(t, Cluster{
+		Name:     "il_user",
+		URL:      "mongodb://host/db",
+		Username: "user",
+		Password: "pass",
+		Config:   "table: {}",
+		Options:  map[string]string{"readPreference": "secondary"},
+	}, c)
+
+	// other clusters' env vars don't matter
+	_, err = FromEnv("sis", getenv)
+	assert.Error(t, err)
+}
+
+func TestFromRegistry(t *testing.T) {
+	registry := []byte(`
+il:
+  url: ${IL_URL}
+  username: ${IL_USERNAME}
+  password: ${IL_PASSWORD}
+  config_path: s3://bucket/il.yml
+  options:
+    readPreference: secondary
+misc:
+  config: ${MISC_CONFIG}
+legacy:
+  url: ${LEGACY_URL}
+  config: |
+    students:
+      dest: students
+      fields:
+        - source: price$
+          dest: price
+`)
+	getenv := getenvFrom(map[string]string{
+		"IL_URL":      "mongodb://host/db",
+		"IL_USERNAME": "user",
+		"IL_PASSWORD": "pass",
+		"LEGACY_URL":  "mongodb://legacy/db",
+	})
+	c, err := FromRegistry(registry, "il", getenv)
+	assert.NoError(t, err)
+	assert.Equal(t, Cluster{
+		Name:       "il",
+		URL:        "mongodb://host/db",
+		Username:   "user",
+		Password:   "pass",
+		ConfigPath: "s3://bucket/il.yml",
+		Options:    map[string]string{"readPreference": "secondary"},
+	}, c)
+
+	// inline configs aren't expanded
+	c, err = FromRegistry(registry, "legacy", getenv)
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb://legacy/db", c.URL)
+	assert.Contains(t, c.Config, "source: price$\n")
+
+	_, err = FromRegistry(registry, "misc", getenv)
+	assert.Error(t, err, "missing url")
+	_, err = FromRegistry(registry, "sis", getenv)
+	assert.Error(t, err, "missing cluster")
+}
+
+func TestConnectionURL(t *testing.T) {
+	c := Cluster{URL: "mongodb://host1:27017,host2:27017/db?tls=true&readPreference=primary"}
+	u, err := c.ConnectionURL()
+	assert.NoError(t, err)
+	assert.Equal(t, c.URL, u)
+
+	c.Options = map[string]string{"readPreference": "secondary", "authSource": "admin"}
+	u, err = c.ConnectionURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb://host1:27017,host2:27017/db?authSource=admin&readPreference=secondary&tls=true", u)
+}
+
+func TestLookupWithConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("table: {}")
+	assert.NoError(t, err)
+	f.Close()
+	os.Setenv("LOOKUP_TEST_URL", "mongodb://host/db")
+	defer os.Unsetenv("LOOKUP_TEST_URL")
+
+	// the cluster has no config of its own
+	_, err = Lookup("lookup_test")
+	assert.Error(t, err)
+	c, err := LookupWithConfig("lookup_test", f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb://host/db", c.URL)
+	assert.Equal(t, "table: {}", c.Config)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/Clever/mongo-to-s3/cluster"
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/exporter"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/yaml.v2"
+)
+
+// command is a subcommand of the CLI, run with the args after its name. export isn't one
+// of them, since its flags are read by the analytics pipeline.
+type command func(args []string) error
+
+var commands = map[string]command{
+	"validate": validateCommand,
+	"infer":    inferCommand,
+	"preview":  previewCommand,
+	"verify":   verifyCommand,
+}
+
+// runCommand runs the command, exiting if it fails. Logs go to stderr, so that stdout only
+// has the command's output.
+func runCommand(name string, c command, args []string) {
+	log.SetOutput(os.Stderr)
+	exporter.SetLogOutput(os.Stderr)
+	if err := c(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet returns the flag set of a command, whose usage starts with its summary
+func newFlagSet(name, summary string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s: %s\n", os.Args[0], name, summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// sourceFlags pick the config and mongo cluster a command reads. -config resolves a
+// cluster the way export does, and -file and -url replace its config and url. Without
+// -config, -file and -url are all there is, so configs can be tried out locally.
+type sourceFlags struct {
+	cluster    string
+	configFile string
+	url        string
+}
+
+func (f *sourceFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.cluster, "config", "", "Name of the mongo cluster, see \"Clusters\"")
+	fs.StringVar(&f.configFile, "file", "", "Path (local or s3://) of a config file to use instead of the cluster's")
+	fs.StringVar(&f.url, "url", "", "Mongo url to use instead of the cluster's")
+}
+
+// resolve returns the cluster the flags describe
+func (f sourceFlags) resolve() (cluster.Cluster, error) {
+	if f.cluster != "" {
+		c, err := cluster.LookupWithConfig(f.cluster, f.configFile)
+		if err != nil {
+			return c, err
+		}
+		if f.url != "" {
+			c.URL = f.url
+		}
+		return c, nil
+	}
+	c := cluster.Cluster{URL: f.url}
+	if f.configFile != "" {
+		data, err := cluster.ReadPath(f.configFile)
+		if err != nil {
+			return c, fmt.Errorf("reading %s: %s", f.configFile, err)
+		}
+		c.Config = string(data)
+	}
+	return c, nil
+}
+
+// table returns the table of the cluster's config at key
+func (f sourceFlags) table(c cluster.Cluster, key string) (config.Table, error) {
+	if c.Config == "" {
+		return config.Table{}, errors.New("-config or -file is required")
+	}
+	configYaml, err := config.ParseYAML([]byte(c.Config))
+	if err != nil {
+		return config.Table{}, err
+	}
+	table, ok := configYaml[key]
+	if !ok {
+		return config.Table{}, fmt.Errorf("table %s is not in the config", key)
+	}
+	return table, nil
+}
+
+// connect connects to the cluster's database
+func connect(ctx context.Context, c cluster.Cluster) (*mongo.Database, error) {
+	if c.URL == "" {
+		return nil, errors.New("-config or -url is required")
+	}
+	url, err := c.ConnectionURL()
+	if err != nil {
+		return nil, err
+	}
+	return exporter.Connect(ctx, url, c.Username, c.Password)
+}
+
+// signalContext returns a context that is cancelled by SIGINT or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// validateCommand checks that every table of a config is valid and can be exported with
+// the key layout
+func validateCommand(args []string) error {
+	fs := newFlagSet("validate", "parse and check a config")
+	var source sourceFlags
+	source.register(fs)
+	keyLayout := fs.String("keyLayout", exporter.DefaultKeyLayout, "Layout of the S3 keys of tables that don't set their own")
+	fs.Parse(args)
+
+	c, err := source.resolve()
+	if err != nil {
+		return err
+	}
+	if c.Config == "" {
+		return errors.New("-config or -file is required")
+	}
+	configYaml, err := config.ParseYAML([]byte(c.Config))
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for key := range configYaml {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	invalid := 0
+	for _, key := range keys {
+		if _, err := exporter.New(exporter.WithTable(configYaml[key]), exporter.WithKeyLayout(*keyLayout)); err != nil {
+			fmt.Printf("%s: %s\n", key, err)
+			invalid++
+			continue
+		}
+		for _, warning := range configYaml[key].Warnings() {
+			fmt.Printf("%s: warning: %s\n", key, warning)
+		}
+		fmt.Printf("%s: ok\n", key)
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d tables are invalid", invalid, len(keys))
+	}
+	return nil
+}
+
+// inferCommand prints a config table of a collection, inferred from a sample of its
+// documents
+func inferCommand(args []string) error {
+	fs := newFlagSet("infer", "generate a config table from a sample of a collection")
+	var source sourceFlags
+	source.register(fs)
+	collection := fs.String("collection", "", "The collection to sample (required)")
+	sample := fs.Int64("sample", 100, "How many documents to sample")
+	fs.Parse(args)
+	if *collection == "" {
+		return errors.New("-collection is required")
+	}
+
+	c, err := source.resolve()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	db, err := connect(ctx, c)
+	if err != nil {
+		return err
+	}
+	docs, err := exporter.Sample(ctx, db, *collection, *sample)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return fmt.Errorf("collection %s has no documents", *collection)
+	}
+	data, err := yaml.Marshal(config.Config{*collection: config.InferTable(*collection, docs)})
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// previewCommand prints the first rows of a table, the way they would be exported
+func previewCommand(args []string) error {
+	fs := newFlagSet("preview", "print transformed rows of a table as JSON")
+	var source sourceFlags
+	source.register(fs)
+	collection := fs.String("collection", "", "The config table to preview (required)")
+	n := fs.Int64("n", 10, "How many rows to print")
+	fs.Parse(args)
+	if *collection == "" {
+		return errors.New("-collection is required")
+	}
+
+	c, err := source.resolve()
+	if err != nil {
+		return err
+	}
+	table, err := source.table(c, *collection)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	db, err := connect(ctx, c)
+	if err != nil {
+		return err
+	}
+	e, err := exporter.New(exporter.WithTable(table), exporter.WithDatabase(db))
+	if err != nil {
+		return err
+	}
+	_, err = e.Preview(ctx, *n, os.Stdout)
+	return err
+}
+
+// verifyCommand checks that the files of a manifest are all there and unchanged
+func verifyCommand(args []string) error {
+	fs := newFlagSet("verify", "check the files of a manifest against it")
+	manifest := fs.String("manifest", "", "The s3:// or file:// url of the manifest (required)")
+	s3Endpoint := fs.String("s3Endpoint", "", "Endpoint of an S3 compatible store to use instead of AWS")
+	s3PathStyle := fs.Bool("s3PathStyle", false, "Address buckets in the path instead of the host name")
+	s3Region := fs.String("s3Region", "", "Region of the bucket, looked up if not set")
+	fs.Parse(args)
+	if *manifest == "" {
+		return errors.New("-manifest is required")
+	}
+
+	checks, err := exporter.Verify(*manifest, exporter.StorageOptions{
+		Endpoint:  *s3Endpoint,
+		PathStyle: *s3PathStyle,
+		Region:    *s3Region,
+	})
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, check := range checks {
+		if check.Err != nil {
+			fmt.Printf("FAIL %s: %s\n", check.URL, check.Err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", check.URL)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files don't match the manifest", failed, len(checks))
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	json "github.com/pquerna/ffjson/ffjson"
+
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// timestampFormat is RFC3339 with the microsecond precision Redshift timestamps keep
+const timestampFormat = "2006-01-02T15:04:05.999999Z07:00"
+
+const dateFormat = "2006-01-02"
+
+// maximum lengths in bytes of the string types s3-to-redshift creates
+const (
+	textLength     = 256
+	longtextLength = 65535
+)
+
+var varcharRegex = regexp.MustCompile(`^varchar\((\d+)\)$`)
+
+// columnType is a parsed column type, e.g. varchar(64) has base varchar and length 64
+type columnType struct {
+	base   string
+	length int
+}
+
+func parseType(t string) (columnType, error) {
+	switch t {
+	case "boolean", "float", "int", "bigint", "timestamp", "date":
+		return columnType{base: t}, nil
+	case "text":
+		return columnType{base: "varchar", length: textLength}, nil
+	case "longtext":
+		return columnType{base: "varchar", length: longtextLength}, nil
+	}
+	if match := varcharRegex.FindStringSubmatch(t); match != nil {
+		length, err := strconv.Atoi(match[1])
+		if err == nil && length > 0 && length <= longtextLength {
+			return columnType{base: "varchar", length: length}, nil
+		}
+		return columnType{}, fmt.Errorf("invalid varchar length in '%s'", t)
+	}
+	return columnType{}, fmt.Errorf("unknown type '%s'", t)
+}
+
+// BaseType returns the type the column's values are coerced to: boolean, float, int,
+// bigint, timestamp, date or varchar. Timestamps and dates are coerced to strings.
+func (f Field) BaseType() string {
+	colType, _ := parseType(f.Type)
+	return colType.base
+}
+
+// CoercionStats counts the values that could not be coerced to their column's type.
+// It is safe to share between concurrent exports of the same table.
+type CoercionStats struct {
+	mu       sync.Mutex
+	failures map[string]int64
+}
+
+// NewCoercionStats returns an empty CoercionStats
+func NewCoercionStats() *CoercionStats {
+	return &CoercionStats{failures: map[string]int64{}}
+}
+
+func (s *CoercionStats) fail(column string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[column]++
+}
+
+// Failures returns the number of rejected values per destination column
+func (s *CoercionStats) Failures() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures := map[string]int64{}
+	for column, count := range s.failures {
+		failures[column] = count
+	}
+	return failures
+}
+
+// GetCoercionFn returns a function which converts each column's value to the representation
+// s3-to-redshift expects for the column's declared type. Values that can't be converted are
+// replaced with null and counted in stats. Runs after the field map.
+func GetCoercionFn(t Table, stats *CoercionStats) func(optimus.Row) (optimus.Row, error) {
+	// Validate has already checked the types, so parse errors can't happen here. Columns
+	// without a type are left as they are, as are pii columns, which are always booleans.
+	types := map[string]columnType{}
+	for _, field := range t.Columns() {
+		if field.Type == "" || (field.PII && field.Type != "boolean") {
+			continue
+		}
+		types[field.Destination], _ = parseType(field.Type)
+	}
+
+	return func(r optimus.Row) (optimus.Row, error) {
+		for column, val := range r {
+			colType, ok := types[column]
+			if !ok || val == nil {
+				continue
+			}
+			coerced, ok := coerce(val, colType)
+			if !ok {
+				stats.fail(column)
+				coerced = nil
+			}
+			r[column] = coerced
+		}
+		return r, nil
+	}
+}
+
+func coerce(val interface{}, colType columnType) (interface{}, bool) {
+	switch colType.base {
+	case "varchar":
+		s, ok := toString(val)
+		if !ok || len(s) > colType.length {
+			return nil, false
+		}
+		return s, true
+	case "int":
+		i, ok := toInt(val)
+		if !ok || i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, false
+		}
+		return i, true
+	case "bigint":
+		return toInt(val)
+	case "float":
+		return toFloat(val)
+	case "boolean":
+		return toBool(val)
+	case "timestamp":
+		t, ok := toTime(val)
+		if !ok {
+			return nil, false
+		}
+		return t.UTC().Format(timestampFormat), true
+	case "date":
+		t, ok := toTime(val)
+		if !ok {
+			return nil, false
+		}
+		return t.UTC().Format(dateFormat), true
+	}
+	return nil, false
+}
+
+// hexer is implemented by ObjectIds
+type hexer interface {
+	Hex() string
+}
+
+func toString(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case hexer:
+		return v.Hex(), true
+	case time.Time:
+		return v.UTC().Format(timestampFormat), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case fmt.Stringer:
+		return v.String(), true
+	case []string, []interface{}, map[string]interface{}:
+		jsonVal, err := json.Marshal(v)
+		return string(jsonVal), err == nil
+	}
+	return "", false
+}
+
+func toInt(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		// math.MaxInt64 rounds up to 1<<63 as a float64, which is out of range
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toBool(val interface{}) (bool, bool) {
+	switch v := val.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return false, false
+}
+
+func toTime(val interface{}) (time.Time, bool) {
+	switch v := val.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		t, err := time.Parse(dateFormat, v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
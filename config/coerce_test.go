@@ -0,0 +1,123 @@
+package config
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+func TestParseType(t *testing.T) {
+	colType, err := parseType("varchar(64)")
+	assert.NoError(t, err)
+	assert.Equal(t, columnType{base: "varchar", length: 64}, colType)
+
+	colType, err = parseType("text")
+	assert.NoError(t, err)
+	assert.Equal(t, columnType{base: "varchar", length: 256}, colType)
+
+	for _, invalid := range []string{"", "string", "varchar", "varchar(0)", "varchar(70000)"} {
+		_, err := parseType(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestCoercion(t *testing.T) {
+	table := Table{
+		Fields: []Field{
+			{Destination: "id", Type: "text"},
+			{Destination: "count", Type: "int"},
+			{Destination: "big", Type: "bigint"},
+			{Destination: "score", Type: "float"},
+			{Destination: "active", Type: "boolean"},
+			{Destination: "created", Type: "timestamp"},
+			{Destination: "birthday", Type: "date"},
+			{Destination: "code", Type: "varchar(2)"},
+		},
+	}
+	stats := NewCoercionStats()
+	f := GetCoercionFn(table, stats)
+
+	id, _ := primitive.ObjectIDFromHex("5a1b2c3d4e5f6a7b8c9d0e1f")
+	created := time.Date(2016, 1, 27, 21, 0, 0, 500000000, time.FixedZone("PST", -8*60*60))
+	row, err := f(optimus.Row{
+		"id":       id,
+		"count":    int64(12),
+		"big":      float64(1 << 40),
+		"score":    3,
+		"active":   "true",
+		"created":  created,
+		"birthday": created,
+		"code":     "CA",
+		"other":    "untouched",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, optimus.Row{
+		"id":       "5a1b2c3d4e5f6a7b8c9d0e1f",
+		"count":    int64(12),
+		"big":      int64(1 << 40),
+		"score":    float64(3),
+		"active":   true,
+		"created":  "2016-01-28T05:00:00.5Z",
+		"birthday": "2016-01-28",
+		"code":     "CA",
+		"other":    "untouched",
+	}, row)
+	assert.Empty(t, stats.Failures())
+
+	row, err = f(optimus.Row{
+		"count":   int64(1 << 40),
+		"big":     1.5,
+		"score":   "abc",
+		"active":  1,
+		"created": "yesterday",
+		"code":    "CAL",
+		"id":      nil,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, optimus.Row{
+		"count":   nil,
+		"big":     nil,
+		"score":   nil,
+		"active":  nil,
+		"created": nil,
+		"code":    nil,
+		"id":      nil,
+	}, row)
+	assert.Equal(t, map[string]int64{
+		"count":   1,
+		"big":     1,
+		"score":   1,
+		"active":  1,
+		"created": 1,
+		"code":    1,
+	}, stats.Failures())
+}
+
+func TestToInt(t *testing.T) {
+	i, ok := toInt(float64(-1 << 63))
+	assert.True(t, ok)
+	assert.Equal(t, int64(math.MinInt64), i)
+	_, ok = toInt(float64(1 << 63))
+	assert.False(t, ok)
+	_, ok = toInt(float64(math.MaxInt64))
+	assert.False(t, ok)
+}
+
+func TestCoercionUntypedColumns(t *testing.T) {
+	table := Table{
+		Fields: []Field{
+			{Destination: "name"},
+			{Destination: "email", Type: "text", PII: true},
+		},
+	}
+	stats := NewCoercionStats()
+	row, err := GetCoercionFn(table, stats)(optimus.Row{"name": int64(12), "email": true})
+	assert.NoError(t, err)
+	// untyped columns are left as they are, and pii columns stay booleans
+	assert.Equal(t, optimus.Row{"name": int64(12), "email": true}, row)
+	assert.Empty(t, stats.Failures())
+}
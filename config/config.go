@@ -1,11 +1,15 @@
 package config
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
 	json "github.com/pquerna/ffjson/ffjson"
 
 	"gopkg.in/Clever/optimus.v3"
 	"gopkg.in/yaml.v2"
-	"reflect"
 )
 
 type Config map[string]Table
@@ -14,31 +18,412 @@ type Table struct {
 	Destination string  `yaml:"dest"`
 	Source      string  `yaml:"source"`
 	Fields      []Field `yaml:"columns"`
-	Meta        Meta    `yaml:"meta"`
+	Meta        Meta    `yaml:"meta,omitempty"`
 }
 
+// Field is a single column definition. The schema attributes (type, keys, sort order)
+// mirror the Redshift table that s3-to-redshift creates from the same config.
 type Field struct {
 	Destination string `yaml:"dest"`
 	Source      string `yaml:"source"`
-	PII         bool   `yaml:"pii"`
+	PII         bool   `yaml:"pii,omitempty"`
+	Type        string `yaml:"type"`
+	PrimaryKey  bool   `yaml:"primarykey,omitempty"`
+	NotNull     bool   `yaml:"notnull,omitempty"`
+	DistKey     bool   `yaml:"distkey,omitempty"`
+	SortOrder   int    `yaml:"sortord,omitempty"`
 }
 
 type Meta struct {
-	Database       string `yaml:"database"`
-	DataDateColumn string `yaml:"datadatecolumn"`
+	Database       string `yaml:"database,omitempty"`
+	DataDateColumn string `yaml:"datadatecolumn,omitempty"`
+	// Schema is the Redshift schema the table is loaded into, mongo_raw by default
+	Schema string `yaml:"schema,omitempty"`
+	// KeyLayout is the layout of the table's S3 keys: redshift, hive, flat or a template.
+	// It defaults to the run's layout.
+	KeyLayout string `yaml:"key_layout,omitempty"`
 	// UseProjectionOptimization makes the query more efficient by only requesting the
 	// listed fields. However, note that if there are reused fields
 	// (e.g. data.name and data.name.first) then the parent one will not be complete/included
 	// if there are other fields in it. This breaks things like oauthclients and launchpads,
 	// so we can't turn it on for everything
-	UseProjectionOptimization bool `yaml:"projection_optimization"`
+	UseProjectionOptimization bool `yaml:"projection_optimization,omitempty"`
+	// IncrementalField turns on incremental exports: only documents whose value of this
+	// field is greater than the one saved by the previous run are exported. The field must
+	// only ever increase, e.g. _id for insert-only collections or updated_at.
+	IncrementalField string `yaml:"incremental_field,omitempty"`
+	// OperationColumn is the column that change stream exports fill with the event's
+	// operation type (insert, update, replace or delete). Required for cdc mode.
+	OperationColumn string `yaml:"operation_column,omitempty"`
+	// Format is the file format the table is exported in: json (the default), parquet, csv,
+	// tsv or avro
+	Format string `yaml:"format,omitempty"`
+	// Compression is the codec json, csv and tsv files are compressed with: gzip (the
+	// default), zstd, bzip2, lz4 or none. Parquet column chunks are compressed with snappy
+	// (the default) or zstd, and avro blocks with snappy (the default), deflate or null.
+	Compression string `yaml:"compression,omitempty"`
+	// CompressionLevel is the level json, csv and tsv files are compressed at. It defaults
+	// to 1 for gzip, since exports are CPU bound, and to the codec's default otherwise.
+	CompressionLevel int `yaml:"compression_level,omitempty"`
+	// RowGroupMB is the size parquet row groups are buffered up to before being written.
+	// Spectrum and Athena read a row group per task, so it defaults to 128.
+	RowGroupMB int `yaml:"row_group_mb,omitempty"`
+	// NullAs is what csv and tsv files write for null values, an empty field by default
+	NullAs string `yaml:"null_as,omitempty"`
+	// QuoteAll quotes every csv or tsv field instead of only the ones that need it
+	QuoteAll bool `yaml:"quote_all,omitempty"`
+	// Newlines is how csv and tsv files write newlines inside values: quote (the default)
+	// keeps them in a quoted field, escape replaces them with \n and strip with a space
+	Newlines string `yaml:"newlines,omitempty"`
+	// Header starts csv and tsv files with a row of the column names
+	Header bool `yaml:"header,omitempty"`
+	// Distribute is how rows are assigned to the numfiles output files: range (the default)
+	// reads each file from its own range of _ids, roundrobin deals rows out in _id order,
+	// and hash assigns them by the hash of DistributeKey
+	Distribute string `yaml:"distribute,omitempty"`
+	// DistributeKey is the column hash distribution hashes. It defaults to the distkey.
+	DistributeKey string `yaml:"distribute_key,omitempty"`
+	// PartitionColumn writes the rows with each value of the column under their own prefix.
+	// Timestamp and date columns are partitioned by day.
+	PartitionColumn string `yaml:"partition_column,omitempty"`
+	// PartitionManifest is combined (the default) for one manifest of every partition's
+	// files, or partition for a manifest in each partition's prefix
+	PartitionManifest string `yaml:"partition_manifest,omitempty"`
+	// Encryption is how the table's objects are encrypted, the run's encryption by default
+	Encryption *Encryption `yaml:"encryption,omitempty"`
+}
+
+// Encryption is how S3 encrypts the objects a run writes
+type Encryption struct {
+	// Type is aes256 (the default) for SSE-S3 or kms for SSE-KMS
+	Type string `yaml:"type"`
+	// KMSKeyID is the key SSE-KMS encrypts with, the AWS managed key by default
+	KMSKeyID string `yaml:"kms_key_id"`
+	// Context is the SSE-KMS encryption context, which is logged with every use of the key
+	Context map[string]string `yaml:"context"`
+	// BucketKey has SSE-KMS use an S3 bucket key, which cuts down on requests to KMS
+	BucketKey bool `yaml:"bucket_key"`
+}
+
+// Server side encryption types
+const (
+	EncryptionAES256 = "aes256"
+	EncryptionKMS    = "kms"
+)
+
+// EncryptionType returns the type of encryption, defaulting to aes256
+func (e Encryption) EncryptionType() string {
+	if e.Type == "" {
+		return EncryptionAES256
+	}
+	return e.Type
+}
+
+// Validate checks the type and that only kms encryption sets kms options
+func (e Encryption) Validate() error {
+	switch e.EncryptionType() {
+	case EncryptionAES256:
+		if e.KMSKeyID != "" || len(e.Context) > 0 || e.BucketKey {
+			return fmt.Errorf("kms_key_id, context and bucket_key are only supported for kms encryption")
+		}
+	case EncryptionKMS:
+	default:
+		return fmt.Errorf("unknown encryption type '%s'", e.Type)
+	}
+	return nil
+}
+
+// Ways rows can be distributed between output files
+const (
+	DistributeRange      = "range"
+	DistributeRoundRobin = "roundrobin"
+	DistributeHash       = "hash"
+)
+
+// Distribution returns how the table's rows are distributed between files, defaulting
+// to range
+func (m Meta) Distribution() string {
+	if m.Distribute == "" {
+		return DistributeRange
+	}
+	return m.Distribute
 }
 
-// ParseYAML marshalls data into a Config
+// DistributionKey returns the column hash distribution hashes: distribute_key if it is
+// set, otherwise the distkey
+func (t Table) DistributionKey() string {
+	if t.Meta.DistributeKey != "" {
+		return t.Meta.DistributeKey
+	}
+	for _, field := range t.Fields {
+		if field.DistKey {
+			return field.Destination
+		}
+	}
+	return ""
+}
+
+// Manifests partitioned tables can be written with
+const (
+	ManifestCombined  = "combined"
+	ManifestPartition = "partition"
+)
+
+// PartitionField returns the field the table is partitioned by, and false if it isn't
+// partitioned
+func (t Table) PartitionField() (Field, bool) {
+	if t.Meta.PartitionColumn == "" {
+		return Field{}, false
+	}
+	for _, field := range t.Fields {
+		if field.Destination == t.Meta.PartitionColumn {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// DefaultSchema is the schema tables are loaded into unless they set their own
+const DefaultSchema = "mongo_raw"
+
+// SchemaName returns the table's schema, defaulting to DefaultSchema
+func (m Meta) SchemaName() string {
+	if m.Schema == "" {
+		return DefaultSchema
+	}
+	return m.Schema
+}
+
+// Output formats tables can be exported in
+const (
+	FormatJSON    = "json"
+	FormatParquet = "parquet"
+	FormatCSV     = "csv"
+	FormatTSV     = "tsv"
+	FormatAvro    = "avro"
+)
+
+// compressionLevels are the levels the codecs of text formats support
+var compressionLevels = map[string][2]int{
+	"gzip":  {1, 9},
+	"zstd":  {1, 22},
+	"bzip2": {1, 9},
+	"lz4":   {1, 9},
+	"none":  {0, 0},
+}
+
+// Codec returns the codec the table's files are compressed with, defaulting to gzip. It is
+// empty for parquet and avro, which compress their contents themselves.
+func (m Meta) Codec() string {
+	switch m.OutputFormat() {
+	case FormatParquet, FormatAvro:
+		return ""
+	}
+	if m.Compression == "" {
+		return "gzip"
+	}
+	return m.Compression
+}
+
+// OutputFormat returns the table's format, defaulting to json
+func (m Meta) OutputFormat() string {
+	if m.Format == "" {
+		return FormatJSON
+	}
+	return m.Format
+}
+
+// OperationTypeKey is the key change stream rows carry their operation type in until the
+// field map moves it to the OperationColumn. Document fields can't start with $, so it
+// never collides with real data.
+const OperationTypeKey = "$operationType"
+
+// ParseYAML marshalls data into a Config and validates the schema of every table
 func ParseYAML(data []byte) (Config, error) {
 	config := Config{}
-	err := yaml.Unmarshal(data, &config)
-	return config, err
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+
+	// validate in a stable order so the same bad config always reports the same error
+	names := []string{}
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := config[name].Validate(); err != nil {
+			return config, fmt.Errorf("table %s: %s", name, err)
+		}
+	}
+	return config, nil
+}
+
+// Columns returns the fields that are exported, which are the ones with a dest
+func (t Table) Columns() []Field {
+	columns := []Field{}
+	for _, field := range t.Fields {
+		if field.Destination != "" {
+			columns = append(columns, field)
+		}
+	}
+	return columns
+}
+
+// typedFormat reports whether the table's format needs the type of every column, to
+// write its schema
+func (t Table) typedFormat() bool {
+	format := t.Meta.OutputFormat()
+	return format == FormatParquet || format == FormatAvro
+}
+
+// Validate checks that the column definitions form a schema s3-to-redshift can create.
+// Columns without a dest aren't exported, so they aren't checked.
+func (t Table) Validate() error {
+	destinations := map[string]bool{}
+	sortOrders := map[int]string{}
+	distKey := ""
+	for _, field := range t.Columns() {
+		if destinations[field.Destination] {
+			return fmt.Errorf("column %s is declared more than once", field.Destination)
+		}
+		destinations[field.Destination] = true
+
+		if field.Type != "" || t.typedFormat() {
+			if _, err := parseType(field.Type); err != nil {
+				return fmt.Errorf("column %s: %s", field.Destination, err)
+			}
+		}
+		if field.PII && field.Type != "boolean" && t.typedFormat() {
+			// PII columns are exported as whether or not they exist
+			return fmt.Errorf("pii column %s must have type boolean", field.Destination)
+		}
+		if field.PrimaryKey && !field.NotNull {
+			return fmt.Errorf("primarykey column %s must also be notnull", field.Destination)
+		}
+		if field.DistKey {
+			if distKey != "" {
+				return fmt.Errorf("columns %s and %s are both distkeys", distKey, field.Destination)
+			}
+			distKey = field.Destination
+		}
+		if field.SortOrder < 0 {
+			return fmt.Errorf("column %s has negative sortord %d", field.Destination, field.SortOrder)
+		}
+		if field.SortOrder > 0 {
+			if other, ok := sortOrders[field.SortOrder]; ok {
+				return fmt.Errorf("columns %s and %s have the same sortord %d", other, field.Destination, field.SortOrder)
+			}
+			sortOrders[field.SortOrder] = field.Destination
+		}
+	}
+
+	if t.Meta.DataDateColumn != "" && !destinations[t.Meta.DataDateColumn] {
+		return fmt.Errorf("datadatecolumn %s is not a declared column", t.Meta.DataDateColumn)
+	}
+	if t.Meta.OperationColumn != "" && !destinations[t.Meta.OperationColumn] {
+		return fmt.Errorf("operation_column %s is not a declared column", t.Meta.OperationColumn)
+	}
+	switch t.Meta.Distribution() {
+	case DistributeRange, DistributeRoundRobin:
+		if t.Meta.DistributeKey != "" {
+			return fmt.Errorf("distribute_key is only supported for hash distribution")
+		}
+	case DistributeHash:
+		key := t.DistributionKey()
+		if key == "" {
+			return fmt.Errorf("hash distribution needs a distribute_key or distkey")
+		}
+		if !destinations[key] {
+			return fmt.Errorf("distribute_key %s is not a declared column", key)
+		}
+	default:
+		return fmt.Errorf("unknown distribute '%s'", t.Meta.Distribute)
+	}
+	if t.Meta.PartitionColumn != "" && !destinations[t.Meta.PartitionColumn] {
+		return fmt.Errorf("partition_column %s is not a declared column", t.Meta.PartitionColumn)
+	}
+	switch t.Meta.PartitionManifest {
+	case "", ManifestCombined, ManifestPartition:
+		if t.Meta.PartitionManifest != "" && t.Meta.PartitionColumn == "" {
+			return fmt.Errorf("partition_manifest needs a partition_column")
+		}
+	default:
+		return fmt.Errorf("unknown partition_manifest '%s'", t.Meta.PartitionManifest)
+	}
+	if t.Meta.Encryption != nil {
+		if err := t.Meta.Encryption.Validate(); err != nil {
+			return fmt.Errorf("encryption: %s", err)
+		}
+	}
+	return t.Meta.validateFormat()
+}
+
+// validateFormat checks the format and the options that go with it
+func (m Meta) validateFormat() error {
+	format := m.OutputFormat()
+	switch format {
+	case FormatJSON, FormatCSV, FormatTSV:
+		levels, ok := compressionLevels[m.Codec()]
+		if !ok {
+			return fmt.Errorf("unknown compression '%s'", m.Compression)
+		}
+		if m.CompressionLevel != 0 && (m.CompressionLevel < levels[0] || m.CompressionLevel > levels[1]) {
+			return fmt.Errorf("compression_level for %s must be between %d and %d", m.Codec(), levels[0], levels[1])
+		}
+	case FormatParquet:
+		switch m.Compression {
+		case "", "snappy", "zstd":
+		default:
+			return fmt.Errorf("unknown parquet compression '%s'", m.Compression)
+		}
+	case FormatAvro:
+		switch m.Compression {
+		case "", "snappy", "deflate", "null":
+		default:
+			return fmt.Errorf("unknown avro compression '%s'", m.Compression)
+		}
+	default:
+		return fmt.Errorf("unknown format '%s'", m.Format)
+	}
+	if m.Codec() == "" && m.CompressionLevel != 0 {
+		return fmt.Errorf("compression_level is not supported for %s", format)
+	}
+	if m.RowGroupMB < 0 {
+		return fmt.Errorf("row_group_mb must be positive")
+	}
+
+	delimited := format == FormatCSV || format == FormatTSV
+	if !delimited && (m.NullAs != "" || m.QuoteAll || m.Newlines != "" || m.Header) {
+		return fmt.Errorf("null_as, quote_all, newlines and header are only supported for csv and tsv")
+	}
+	switch m.Newlines {
+	case "", "quote", "escape", "strip":
+	default:
+		return fmt.Errorf("unknown newlines '%s'", m.Newlines)
+	}
+	if strings.ContainsAny(m.NullAs, "\"\r\n") {
+		return fmt.Errorf("null_as can't contain quotes or newlines")
+	}
+	return nil
+}
+
+// Warnings describes the columns that are exported differently than they are declared:
+// ones without a dest aren't exported, ones without a type aren't coerced and pii columns
+// are always booleans
+func (t Table) Warnings() []string {
+	warnings := []string{}
+	for _, field := range t.Fields {
+		switch {
+		case field.Destination == "":
+			warnings = append(warnings, fmt.Sprintf("column with source '%s' has no dest, so it isn't exported", field.Source))
+		case field.PII && field.Type != "boolean":
+			warnings = append(warnings, fmt.Sprintf("pii column %s is exported as a boolean, not %s", field.Destination, field.Type))
+		case field.Type == "":
+			warnings = append(warnings, fmt.Sprintf("column %s has no type, so its values aren't coerced", field.Destination))
+		}
+	}
+	return warnings
 }
 
 // FieldMap returns a mapping of all fields between source and destination
@@ -51,6 +436,9 @@ func (t Table) FieldMap() map[string][]string {
 			mappings[field.Source] = append(list, field.Destination)
 		}
 	}
+	if t.Meta.OperationColumn != "" {
+		mappings[OperationTypeKey] = []string{t.Meta.OperationColumn}
+	}
 
 	return mappings
 }
@@ -64,6 +452,27 @@ func GetPopulateDateFn(dataDateColumn, timestamp string) func(optimus.Row) (opti
 	}
 }
 
+// GetSchemaEnforcerFn returns a function which makes each row match the declared columns:
+// every column is present (missing values become null), undeclared keys are dropped and
+// notnull columns must have a value. Change stream deletes only carry the document's key,
+// so for them only primarykey columns must have a value. Runs after the field map and the
+// data date is populated.
+func GetSchemaEnforcerFn(t Table) func(optimus.Row) (optimus.Row, error) {
+	return func(r optimus.Row) (optimus.Row, error) {
+		isDelete := t.Meta.OperationColumn != "" && r[t.Meta.OperationColumn] == "delete"
+		outRow := optimus.Row{}
+		for _, field := range t.Columns() {
+			val := r[field.Destination]
+			required := field.NotNull && (!isDelete || field.PrimaryKey)
+			if val == nil && required {
+				return nil, fmt.Errorf("column %s is notnull but has no value", field.Destination)
+			}
+			outRow[field.Destination] = val
+		}
+		return outRow, nil
+	}
+}
+
 // GetExistentialTransformerFn returns a function which turns a PII field into a boolean
 // whether it exists or not. Runs before the field map.
 func GetExistentialTransformerFn(t Table) func(optimus.Row) (optimus.Row, error) {
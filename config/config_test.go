@@ -73,6 +73,256 @@ func TestInvalidYAML(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestSchemaYAML(t *testing.T) {
+	config, err := ParseYAML([]byte(`
+table1:
+  dest: table1_dest
+  source: table1_source
+  columns:
+  - dest: _data_timestamp
+    type: timestamp
+    sortord: 1
+  - dest: id
+    source: _id
+    type: text
+    primarykey: true
+    notnull: true
+    distkey: true
+  meta:
+    datadatecolumn: _data_timestamp
+`))
+	assert.NoError(t, err)
+
+	fields := config["table1"].Fields
+	assert.Equal(t, Field{Destination: "_data_timestamp", Type: "timestamp", SortOrder: 1}, fields[0])
+	assert.Equal(t, Field{Destination: "id", Source: "_id", Type: "text", PrimaryKey: true, NotNull: true, DistKey: true}, fields[1])
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string][]Field{
+		"unknown type": {
+			{Destination: "id", Source: "_id", Type: "string"},
+		},
+		"two distkeys": {
+			{Destination: "id", Source: "_id", Type: "text", DistKey: true},
+			{Destination: "district", Source: "district", Type: "text", DistKey: true},
+		},
+		"duplicate sortord": {
+			{Destination: "id", Source: "_id", Type: "text", SortOrder: 1},
+			{Destination: "district", Source: "district", Type: "text", SortOrder: 1},
+		},
+		"primarykey without notnull": {
+			{Destination: "id", Source: "_id", Type: "text", PrimaryKey: true},
+		},
+		"duplicate dest": {
+			{Destination: "id", Source: "_id", Type: "text"},
+			{Destination: "id", Source: "id", Type: "text"},
+		},
+	}
+	for name, fields := range tests {
+		err := Table{Fields: fields}.Validate()
+		assert.Error(t, err, name)
+	}
+
+	err := Table{
+		Fields: []Field{{Destination: "id", Source: "_id", Type: "text"}},
+		Meta:   Meta{DataDateColumn: "_data_timestamp"},
+	}.Validate()
+	assert.Error(t, err, "undeclared datadatecolumn")
+}
+
+func TestValidateDeployedColumns(t *testing.T) {
+	// columns deployed configs have, which are exported the way they always were
+	fields := []Field{
+		{Destination: "id", Source: "_id", Type: "text"},
+		{Source: "legacy"},
+		{Destination: "name", Source: "name"},
+		{Destination: "email", Source: "email", Type: "text", PII: true},
+	}
+	table := Table{Fields: fields}
+	assert.NoError(t, table.Validate())
+	assert.Equal(t, []string{"id", "name", "email"}, destinations(table.Columns()))
+	assert.Equal(t, []string{
+		"column with source 'legacy' has no dest, so it isn't exported",
+		"column name has no type, so its values aren't coerced",
+		"pii column email is exported as a boolean, not text",
+	}, table.Warnings())
+
+	// parquet and avro schemas need every column's type
+	for _, format := range []string{FormatParquet, FormatAvro} {
+		assert.Error(t, Table{Fields: fields[:3], Meta: Meta{Format: format}}.Validate(), format)
+		assert.Error(t, Table{Fields: []Field{fields[0], fields[3]}, Meta: Meta{Format: format}}.Validate(), format)
+		assert.NoError(t, Table{Fields: fields[:2], Meta: Meta{Format: format}}.Validate(), format)
+	}
+}
+
+func destinations(fields []Field) []string {
+	dests := []string{}
+	for _, f := range fields {
+		dests = append(dests, f.Destination)
+	}
+	return dests
+}
+
+func TestValidateDistribute(t *testing.T) {
+	fields := []Field{
+		{Destination: "id", Source: "_id", Type: "text"},
+		{Destination: "district_id", Source: "district", Type: "text", DistKey: true},
+	}
+	valid := []Meta{
+		{},
+		{Distribute: "roundrobin"},
+		{Distribute: "hash"},
+		{Distribute: "hash", DistributeKey: "id"},
+	}
+	for _, meta := range valid {
+		assert.NoError(t, Table{Fields: fields, Meta: meta}.Validate(), "%#v", meta)
+	}
+	assert.Equal(t, "district_id", Table{Fields: fields}.DistributionKey())
+	assert.Equal(t, "id", Table{Fields: fields, Meta: Meta{DistributeKey: "id"}}.DistributionKey())
+
+	invalid := []Meta{
+		{Distribute: "random"},
+		{Distribute: "hash", DistributeKey: "name"},
+		{Distribute: "range", DistributeKey: "id"},
+	}
+	for _, meta := range invalid {
+		assert.Error(t, Table{Fields: fields, Meta: meta}.Validate(), "%#v", meta)
+	}
+	assert.Error(t, Table{Fields: fields[:1], Meta: Meta{Distribute: "hash"}}.Validate(), "hash without a key")
+}
+
+func TestValidatePartition(t *testing.T) {
+	fields := []Field{
+		{Destination: "id", Source: "_id", Type: "text"},
+		{Destination: "district_id", Source: "district", Type: "text"},
+	}
+	valid := []Meta{
+		{PartitionColumn: "district_id"},
+		{PartitionColumn: "district_id", PartitionManifest: "combined"},
+		{PartitionColumn: "district_id", PartitionManifest: "partition"},
+	}
+	for _, meta := range valid {
+		assert.NoError(t, Table{Fields: fields, Meta: meta}.Validate(), "%#v", meta)
+	}
+	field, ok := Table{Fields: fields, Meta: Meta{PartitionColumn: "district_id"}}.PartitionField()
+	assert.True(t, ok)
+	assert.Equal(t, "district", field.Source)
+	_, ok = Table{Fields: fields}.PartitionField()
+	assert.False(t, ok)
+
+	invalid := []Meta{
+		{PartitionColumn: "school_id"},
+		{PartitionColumn: "district_id", PartitionManifest: "each"},
+		{PartitionManifest: "partition"},
+	}
+	for _, meta := range invalid {
+		assert.Error(t, Table{Fields: fields, Meta: meta}.Validate(), "%#v", meta)
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	fields := []Field{{Destination: "id", Source: "_id", Type: "text"}}
+	valid := []Encryption{
+		{},
+		{Type: "aes256"},
+		{Type: "kms"},
+		{Type: "kms", KMSKeyID: "alias/student-data", Context: map[string]string{"app": "mongo-to-s3"}, BucketKey: true},
+	}
+	for _, encryption := range valid {
+		e := encryption
+		assert.NoError(t, Table{Fields: fields, Meta: Meta{Encryption: &e}}.Validate(), "%#v", e)
+	}
+	assert.Equal(t, "aes256", Encryption{}.EncryptionType())
+
+	invalid := []Encryption{
+		{Type: "sse-c"},
+		{KMSKeyID: "alias/student-data"},
+		{Type: "aes256", BucketKey: true},
+		{Context: map[string]string{"app": "mongo-to-s3"}},
+	}
+	for _, encryption := range invalid {
+		e := encryption
+		assert.Error(t, Table{Fields: fields, Meta: Meta{Encryption: &e}}.Validate(), "%#v", e)
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	fields := []Field{{Destination: "id", Source: "_id", Type: "text"}}
+	valid := []Meta{
+		{},
+		{Format: "json"},
+		{Format: "parquet"},
+		{Format: "parquet", Compression: "zstd", RowGroupMB: 64},
+		{Format: "csv", NullAs: `\N`, QuoteAll: true, Newlines: "escape", Header: true},
+		{Format: "tsv", Newlines: "strip"},
+		{Format: "avro", Compression: "deflate"},
+		{Compression: "zstd", CompressionLevel: 19},
+		{Format: "csv", Compression: "none"},
+		{Format: "tsv", Compression: "lz4", CompressionLevel: 9},
+		{CompressionLevel: 9},
+	}
+	for _, meta := range valid {
+		assert.NoError(t, Table{Fields: fields, Meta: meta}.Validate(), "%#v", meta)
+	}
+	invalid := []Meta{
+		{Format: "xml"},
+		{Format: "json", Compression: "snappy"},
+		{Compression: "gzip", CompressionLevel: 10},
+		{Compression: "none", CompressionLevel: 1},
+		{Format: "parquet", CompressionLevel: 3},
+		{Format: "parquet", Compression: "lzo"},
+		{Format: "parquet", RowGroupMB: -1},
+		{Format: "json", Header: true},
+		{Format: "csv", Newlines: "drop"},
+		{Format: "csv", NullAs: `"`},
+		{Format: "avro", Compression: "zstd"},
+	}
+	for _, meta := range invalid {
+		assert.Error(t, Table{Fields: fields, Meta: meta}.Validate(), "%#v", meta)
+	}
+}
+
+func TestSchemaEnforcer(t *testing.T) {
+	table := Table{
+		Fields: []Field{
+			{Destination: "id", Source: "_id", Type: "text", NotNull: true},
+			{Destination: "name", Source: "name", Type: "text"},
+		},
+	}
+	f := GetSchemaEnforcerFn(table)
+
+	row, err := f(optimus.Row{"id": "1", "extra": "nope"})
+	assert.NoError(t, err)
+	assert.Equal(t, optimus.Row{"id": "1", "name": nil}, row)
+
+	_, err = f(optimus.Row{"name": "foo"})
+	assert.Error(t, err)
+}
+
+func TestSchemaEnforcerDeletes(t *testing.T) {
+	table := Table{
+		Fields: []Field{
+			{Destination: "id", Source: "_id", Type: "text", PrimaryKey: true, NotNull: true},
+			{Destination: "name", Source: "name", Type: "text", NotNull: true},
+			{Destination: "op", Type: "text"},
+		},
+		Meta: Meta{OperationColumn: "op"},
+	}
+	assert.Equal(t, []string{"op"}, table.FieldMap()[OperationTypeKey])
+	f := GetSchemaEnforcerFn(table)
+
+	// deletes only need their primary key
+	row, err := f(optimus.Row{"id": "1", "op": "delete"})
+	assert.NoError(t, err)
+	assert.Equal(t, optimus.Row{"id": "1", "name": nil, "op": "delete"}, row)
+
+	_, err = f(optimus.Row{"id": "1", "op": "update"})
+	assert.Error(t, err)
+	_, err = f(optimus.Row{"op": "delete"})
+	assert.Error(t, err)
+}
+
 func TestFieldMap(t *testing.T) {
 	table := Table{
 		Fields: []Field{
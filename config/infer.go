@@ -0,0 +1,108 @@
+package config
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// columnSample is what has been seen of a column's values
+type columnSample struct {
+	// kinds are the types the values could be stored as
+	kinds map[string]bool
+	// maxLength is the length of the longest value as a string
+	maxLength int
+}
+
+// observe records a value of the column
+func (c *columnSample) observe(val interface{}) {
+	switch val.(type) {
+	case nil:
+		return
+	case bool:
+		c.kinds["boolean"] = true
+	case int32:
+		c.kinds["int"] = true
+	case int, int64:
+		c.kinds["bigint"] = true
+	case float64:
+		c.kinds["float"] = true
+	case time.Time:
+		c.kinds["timestamp"] = true
+	default:
+		c.kinds["varchar"] = true
+	}
+	if s, ok := toString(val); ok && len(s) > c.maxLength {
+		c.maxLength = len(s)
+	}
+}
+
+// columnType returns the narrowest type that holds every value seen. Numbers widen to
+// the widest number seen, and mixed or other values are stored as text, or longtext when
+// they're longer than text allows.
+func (c *columnSample) columnType() string {
+	numbers := c.kinds["int"] || c.kinds["bigint"] || c.kinds["float"]
+	switch {
+	case len(c.kinds) == 1 && c.kinds["boolean"]:
+		return "boolean"
+	case len(c.kinds) == 1 && c.kinds["timestamp"]:
+		return "timestamp"
+	case numbers && !c.kinds["boolean"] && !c.kinds["timestamp"] && !c.kinds["varchar"]:
+		if c.kinds["float"] {
+			return "float"
+		} else if c.kinds["bigint"] {
+			return "bigint"
+		}
+		return "int"
+	case c.maxLength > textLength:
+		return "longtext"
+	}
+	return "text"
+}
+
+// InferTable returns a table of the collection with a column for each field of the sample
+// documents, which are flattened the way exports flatten them. The _id is the primary key,
+// and fields are named after their path with dots replaced by underscores. The types only
+// fit the sample, so they are a starting point to be reviewed.
+func InferTable(collection string, docs []optimus.Row) Table {
+	flatten := Flattener()
+	samples := map[string]*columnSample{}
+	for _, doc := range docs {
+		row, _ := flatten(doc)
+		for key, val := range row {
+			if samples[key] == nil {
+				samples[key] = &columnSample{kinds: map[string]bool{}}
+			}
+			samples[key].observe(val)
+		}
+	}
+
+	sources := []string{}
+	for source := range samples {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		// the primary key goes first
+		if (sources[i] == "_id") != (sources[j] == "_id") {
+			return sources[i] == "_id"
+		}
+		return sources[i] < sources[j]
+	})
+	table := Table{Destination: collection, Source: collection}
+	for _, source := range sources {
+		field := Field{
+			Destination: strings.ToLower(strings.Replace(source, ".", "_", -1)),
+			Source:      source,
+			Type:        samples[source].columnType(),
+		}
+		if source == "_id" {
+			field.Destination = "id"
+			field.PrimaryKey = true
+			field.NotNull = true
+		}
+		table.Fields = append(table.Fields, field)
+	}
+	return table
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+func TestInferTable(t *testing.T) {
+	created := time.Date(2016, 1, 27, 21, 0, 0, 0, time.UTC)
+	docs := []optimus.Row{
+		{"_id": "a", "name": map[string]interface{}{"First": "Ada"}, "grade": int32(3), "score": int64(90), "active": true, "created": created},
+		{"_id": "b", "grade": int32(4), "score": 92.5, "active": "yes", "bio": strings.Repeat("x", 300)},
+	}
+	table := InferTable("students", docs)
+	assert.Equal(t, "students", table.Destination)
+	assert.Equal(t, "students", table.Source)
+	assert.Equal(t, []Field{
+		{Destination: "id", Source: "_id", Type: "text", PrimaryKey: true, NotNull: true},
+		{Destination: "active", Source: "active", Type: "text"},
+		{Destination: "bio", Source: "bio", Type: "longtext"},
+		{Destination: "created", Source: "created", Type: "timestamp"},
+		{Destination: "grade", Source: "grade", Type: "int"},
+		{Destination: "name_first", Source: "name.First", Type: "text"},
+		{Destination: "score", Source: "score", Type: "float"},
+	}, table.Fields)
+	assert.NoError(t, table.Validate())
+}
@@ -0,0 +1,156 @@
+package exporter
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// abortTimeout is how long in-flight uploads get to stop before an export's files are deleted
+const abortTimeout = 20 * time.Second
+
+// runAborter stops an export that failed or whose context was cancelled. It cancels the
+// export's context and closes its pipes, which stops the mongo cursors and makes in-flight
+// uploads abort, and once the export has stopped it deletes the data files the export
+// wrote that haven't been committed.
+type runAborter struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	pipes    map[*io.PipeWriter]bool
+	files    map[string]storedFile
+	firstErr error
+	inFlight sync.WaitGroup
+}
+
+// storedFile is a file the export has written
+type storedFile struct {
+	store Storage
+	key   string
+}
+
+// newRunAborter returns an aborter for an export. Cancelling parent aborts the export
+// with ErrAborted.
+func newRunAborter(parent context.Context) *runAborter {
+	ctx, cancel := context.WithCancel(parent)
+	a := &runAborter{
+		ctx:    ctx,
+		cancel: cancel,
+		pipes:  map[*io.PipeWriter]bool{},
+		files:  map[string]storedFile{},
+	}
+	go func() {
+		<-ctx.Done()
+		if parent.Err() != nil {
+			a.fail(ErrAborted)
+		}
+	}()
+	return a
+}
+
+// context returns the export's context, which is cancelled when the export fails
+func (a *runAborter) context() context.Context {
+	return a.ctx
+}
+
+// pipe returns a pipe that is closed with the export's error if it fails. release must
+// be called once the pipe is closed.
+func (a *runAborter) pipe() (*io.PipeReader, *io.PipeWriter) {
+	reader, writer := io.Pipe()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.firstErr != nil {
+		writer.CloseWithError(a.firstErr)
+	}
+	a.pipes[writer] = true
+	return reader, writer
+}
+
+func (a *runAborter) release(writer *io.PipeWriter) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pipes, writer)
+}
+
+// track records data files the export is writing, so that they are deleted if it fails
+func (a *runAborter) track(store Storage, keys ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range keys {
+		a.files[store.url(key)] = storedFile{store: store, key: key}
+	}
+}
+
+// forget stops tracking files once they have been committed
+func (a *runAborter) forget(store Storage, keys ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range keys {
+		delete(a.files, store.url(key))
+	}
+}
+
+// startUpload records an upload that cleanup has to wait for. The returned function ends it.
+func (a *runAborter) startUpload() func() {
+	a.inFlight.Add(1)
+	return a.inFlight.Done
+}
+
+// fail stops the export with err. Only the first error is kept, since the ones after it
+// are usually caused by the export being stopped.
+func (a *runAborter) fail(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.firstErr != nil {
+		return
+	}
+	a.firstErr = err
+	a.cancel()
+	for writer := range a.pipes {
+		writer.CloseWithError(err)
+	}
+}
+
+// err returns the error the export failed with, or nil if it hasn't failed
+func (a *runAborter) err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.firstErr
+}
+
+// cleanup waits for in-flight uploads to stop and deletes the files that were written but
+// not committed. It is called once the export has failed and its goroutines have returned.
+func (a *runAborter) cleanup() {
+	uploadsStopped := make(chan struct{})
+	go func() {
+		a.inFlight.Wait()
+		close(uploadsStopped)
+	}()
+	select {
+	case <-uploadsStopped:
+	case <-time.After(abortTimeout):
+		log.Warn("abort-upload-timeout")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deleted := 0
+	for location, f := range a.files {
+		if err := f.store.remove(f.key); err != nil {
+			log.ErrorD("abort-delete-error", logger.M{"path": location, "error": err.Error()})
+			continue
+		}
+		deleted++
+	}
+	a.files = map[string]storedFile{}
+	log.InfoD("export-aborted", logger.M{"error": a.firstErr.Error(), "deleted-files": deleted})
+}
+
+// stop releases the aborter once the export is over
+func (a *runAborter) stop() {
+	a.cancel()
+}
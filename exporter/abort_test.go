@@ -0,0 +1,66 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunAborterFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongo-to-s3")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := localStorage{dir: dir, checksum: checksumAlgorithms["sha256"]}
+
+	a := newRunAborter(context.Background())
+	defer a.stop()
+	// a committed file, a file being written and a file that's still being uploaded
+	_, err = uploadFile(strings.NewReader("committed"), store, "a_0.json.gz")
+	assert.NoError(t, err)
+	a.track(store, "a_0.json.gz")
+	a.forget(store, "a_0.json.gz")
+	_, err = uploadFile(strings.NewReader("partial"), store, "b_0.json.gz")
+	assert.NoError(t, err)
+	a.track(store, "b_0.json.gz")
+	reader, writer := a.pipe()
+	uploaded := a.startUpload()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(reader)
+		readErr <- err
+		uploaded()
+	}()
+	writer.Write([]byte("rows"))
+
+	failure := errors.New("upload failed")
+	a.fail(failure)
+	// only the first error is kept
+	a.fail(errors.New("pipe closed"))
+	assert.Equal(t, failure, <-readErr)
+	assert.Equal(t, failure, a.err())
+	assert.Error(t, a.context().Err())
+
+	a.cleanup()
+	_, err = store.read("a_0.json.gz")
+	assert.NoError(t, err)
+	_, err = store.read("b_0.json.gz")
+	assert.Equal(t, errFileNotFound, err)
+}
+
+func TestRunAborterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := newRunAborter(ctx)
+	defer a.stop()
+	reader, _ := a.pipe()
+	assert.NoError(t, a.err())
+
+	cancel()
+	_, err := ioutil.ReadAll(reader)
+	assert.Equal(t, ErrAborted, err)
+	assert.Equal(t, ErrAborted, a.err())
+}
@@ -0,0 +1,119 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/linkedin/goavro/v2"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// avroBlockSize is the number of records written to each block of an avro file
+const avroBlockSize = 1000
+
+var avroNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// avroType returns the avro type of a base type, along with the name that goavro gives it
+// as a branch of a union
+func avroType(baseType string) (interface{}, string) {
+	switch baseType {
+	case "boolean":
+		return "boolean", "boolean"
+	case "int":
+		return "int", "int"
+	case "bigint":
+		return "long", "long"
+	case "float":
+		return "double", "double"
+	case "timestamp":
+		return map[string]string{"type": "long", "logicalType": "timestamp-micros"}, "long.timestamp-micros"
+	case "date":
+		return map[string]string{"type": "int", "logicalType": "date"}, "int.date"
+	}
+	return "string", "string"
+}
+
+// avroSchema returns the schema of a record with the table's columns in the order they are
+// declared. Nullable columns are unions with null, which is also their default.
+func avroSchema(t config.Table) ([]byte, error) {
+	if !avroNameRegex.MatchString(t.Destination) {
+		return nil, fmt.Errorf("dest %s is not a valid avro name", t.Destination)
+	}
+	fields := []map[string]interface{}{}
+	for _, field := range t.Columns() {
+		if !avroNameRegex.MatchString(field.Destination) {
+			return nil, fmt.Errorf("column %s is not a valid avro name", field.Destination)
+		}
+		fieldType, _ := avroType(field.BaseType())
+		if columnRequired(t, field) {
+			fields = append(fields, map[string]interface{}{"name": field.Destination, "type": fieldType})
+		} else {
+			fields = append(fields, map[string]interface{}{"name": field.Destination, "type": []interface{}{"null", fieldType}, "default": nil})
+		}
+	}
+	return json.MarshalIndent(map[string]interface{}{
+		"type":   "record",
+		"name":   t.Destination,
+		"fields": fields,
+	}, "", "  ")
+}
+
+// avroSink writes the rows to an avro object container file, which embeds the schema
+func avroSink(t config.Table, w io.Writer) optimus.Sink {
+	columns := t.Columns()
+	return func(source optimus.Table) error {
+		defer source.Stop()
+		schema, err := avroSchema(t)
+		if err != nil {
+			return err
+		}
+		compression := t.Meta.Compression
+		if compression == "" {
+			compression = goavro.CompressionSnappyLabel
+		}
+		ocf, err := goavro.NewOCFWriter(goavro.OCFConfig{W: w, Schema: string(schema), CompressionName: compression})
+		if err != nil {
+			return err
+		}
+
+		baseTypes := make([]string, len(columns))
+		unionNames := make([]string, len(columns))
+		for i, field := range columns {
+			baseTypes[i] = field.BaseType()
+			if !columnRequired(t, field) {
+				_, unionNames[i] = avroType(baseTypes[i])
+			}
+		}
+		block := make([]interface{}, 0, avroBlockSize)
+		for row := range source.Rows() {
+			record := map[string]interface{}{}
+			for i, field := range columns {
+				val, err := binaryValue(baseTypes[i], row[field.Destination])
+				if err != nil {
+					return fmt.Errorf("column %s: %s", field.Destination, err)
+				}
+				if unionNames[i] != "" && val != nil {
+					val = goavro.Union(unionNames[i], val)
+				}
+				record[field.Destination] = val
+			}
+			block = append(block, record)
+			if len(block) == avroBlockSize {
+				if err := ocf.Append(block); err != nil {
+					return err
+				}
+				block = block[:0]
+			}
+		}
+		if err := source.Err(); err != nil {
+			return err
+		}
+		if len(block) > 0 {
+			return ocf.Append(block)
+		}
+		return nil
+	}
+}
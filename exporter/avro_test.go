@@ -0,0 +1,71 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/Clever/optimus.v3"
+	"gopkg.in/Clever/optimus.v3/sources/slice"
+)
+
+var avroTable = config.Table{
+	Destination: "students",
+	Fields: []config.Field{
+		{Destination: "id", Type: "text", PrimaryKey: true, NotNull: true},
+		{Destination: "grade", Type: "int"},
+		{Destination: "created", Type: "timestamp"},
+	},
+}
+
+func TestAvroSchema(t *testing.T) {
+	schema, err := avroSchema(avroTable)
+	assert.NoError(t, err)
+	parsed := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(schema, &parsed))
+	assert.Equal(t, map[string]interface{}{
+		"type": "record",
+		"name": "students",
+		"fields": []interface{}{
+			map[string]interface{}{"name": "id", "type": "string"},
+			map[string]interface{}{"name": "grade", "type": []interface{}{"null", "int"}, "default": nil},
+			map[string]interface{}{"name": "created", "type": []interface{}{"null",
+				map[string]interface{}{"type": "long", "logicalType": "timestamp-micros"}}, "default": nil},
+		},
+	}, parsed)
+
+	invalid := avroTable
+	invalid.Fields = []config.Field{{Destination: "data.type", Type: "text"}}
+	_, err = avroSchema(invalid)
+	assert.Error(t, err)
+}
+
+func TestAvroSink(t *testing.T) {
+	out := &bytes.Buffer{}
+	rows := []optimus.Row{
+		{"id": "1", "grade": int64(5), "created": "2016-01-27T21:00:00.000001Z"},
+		{"id": "2", "grade": nil, "created": nil},
+	}
+	assert.NoError(t, avroSink(avroTable, out)(slice.New(rows)))
+
+	reader, err := goavro.NewOCFReader(out)
+	assert.NoError(t, err)
+	records := []interface{}{}
+	for reader.Scan() {
+		record, err := reader.Read()
+		assert.NoError(t, err)
+		records = append(records, record)
+	}
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"id":      "1",
+			"grade":   map[string]interface{}{"int": int32(5)},
+			"created": map[string]interface{}{"long.timestamp-micros": time.Date(2016, 1, 27, 21, 0, 0, 1000, time.UTC)},
+		},
+		map[string]interface{}{"id": "2", "grade": nil, "created": nil},
+	}, records)
+}
@@ -0,0 +1,306 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// chanTable is an optimus.Table fed one row at a time, so that a long-running stream can be
+// cut into files that each go through exportData
+type chanTable struct {
+	rows      chan optimus.Row
+	stopped   chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+func newChanTable() *chanTable {
+	return &chanTable{rows: make(chan optimus.Row), stopped: make(chan struct{})}
+}
+
+func (t *chanTable) Rows() <-chan optimus.Row { return t.rows }
+func (t *chanTable) Err() error               { return nil }
+func (t *chanTable) Stop()                    { t.stopOnce.Do(func() { close(t.stopped) }) }
+
+// end tells the table's reader that there are no more rows
+func (t *chanTable) end() { t.closeOnce.Do(func() { close(t.rows) }) }
+
+// send passes a row to the table's reader, dropping it if the reader has stopped
+func (t *chanTable) send(r optimus.Row) {
+	select {
+	case t.rows <- r:
+	case <-t.stopped:
+	}
+}
+
+// changeEvent is the part of a change stream event that gets exported
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	FullDocument  bson.M `bson:"fullDocument"`
+	DocumentKey   bson.M `bson:"documentKey"`
+}
+
+// changeEventRow turns an event into a raw row. Deletes, and updates to documents that
+// have been deleted since, only have the document's key.
+func changeEventRow(ev changeEvent) optimus.Row {
+	doc := ev.FullDocument
+	if ev.OperationType == "delete" || doc == nil {
+		doc = ev.DocumentKey
+	}
+	row := normalizeDocument(doc)
+	row[config.OperationTypeKey] = ev.OperationType
+	return row
+}
+
+// formatResumeTokenFilename returns the key of the change stream checkpoint for a table,
+// under its schema like its watermark
+func formatResumeTokenFilename(t config.Table) string {
+	return path.Join(t.Meta.SchemaName(), t.Destination, "_resume_token.json")
+}
+
+// cdcBucket is a time-bucketed file that change events are streamed into
+type cdcBucket struct {
+	keys      keyNamer
+	closesAt  time.Time
+	fileIndex string
+	output    dataFile
+	source    *chanTable
+	count     int
+	done      chan struct{}
+}
+
+// openCDCBucket starts exporting and uploading a new file for events in the bucket
+// beginning at start
+func openCDCBucket(a *runAborter, run exportRun, table config.Table, start time.Time, interval time.Duration, stats *config.CoercionStats) (*cdcBucket, error) {
+	store := run.tableStorage(table)
+	timestamp := start.Format(time.RFC3339)
+	// each bucket's files are named after its start, like a snapshot's data date
+	run.timestamp = timestamp
+	keys, err := run.tableKeyNamer(table)
+	if err != nil {
+		return nil, &ConfigError{Table: table.Destination, Err: err}
+	}
+	// buckets can be reopened after a restart, so the flush time keeps file names unique
+	fileIndex := "cdc_" + strconv.FormatInt(time.Now().Unix(), 10)
+	b := &cdcBucket{
+		keys:      keys,
+		closesAt:  start.Add(interval),
+		fileIndex: fileIndex,
+		output:    dataFile{Name: keys.key(fileIndex, dataFileExtension(table))},
+		source:    newChanTable(),
+		done:      make(chan struct{}),
+	}
+	log.InfoD("cdc-bucket-open", logger.M{"collection": table.Destination, "location": b.output.Name})
+	if err := copySchemaFile(store, keys, table); err != nil {
+		return nil, err
+	}
+
+	reader, writer := a.pipe()
+	// the file is deleted if the stream fails before its manifest is uploaded
+	a.track(store, run.stagingKey(b.output.Name), b.output.Name)
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		defer a.release(writer)
+		defer writer.Close()
+		output := &countingWriter{w: writer}
+		count, err := exportData(b.source, table, newDataFileSink(table, output), timestamp, stats)
+		if err != nil {
+			a.fail(&ReadError{Table: table.Destination, Err: err})
+			return
+		}
+		b.count = count
+		b.output.ContentLength = output.count()
+	}()
+	done := a.startUpload()
+	go func() {
+		defer waitGroup.Done()
+		defer done()
+		var err error
+		if b.output.Digest, err = uploadFile(reader, store, run.stagingKey(b.output.Name)); err != nil {
+			a.fail(err)
+			reader.CloseWithError(err)
+		}
+	}()
+	go func() {
+		waitGroup.Wait()
+		close(b.done)
+	}()
+	return b, nil
+}
+
+// finish ends the bucket's file and waits for it to be uploaded along with its manifest
+func (b *cdcBucket) finish(a *runAborter, run exportRun, store Storage, collectionName string) error {
+	b.source.end()
+	<-b.done
+	if err := a.err(); err != nil {
+		return err
+	}
+	log.InfoD("output-destination", logger.M{"collection": collectionName, "count": b.count, "location": b.output.Name})
+	if err := publishFiles(run, store, []dataFile{b.output}); err != nil {
+		return err
+	}
+
+	manifestFilename := b.keys.key(b.fileIndex, ".manifest")
+	manifestReader, err := createManifest(store, []dataFile{b.output})
+	if err != nil {
+		return err
+	}
+	if _, err := uploadFile(manifestReader, store, manifestFilename); err != nil {
+		return err
+	}
+	a.forget(store, run.stagingKey(b.output.Name), b.output.Name)
+	return nil
+}
+
+// readResumeToken fetches the checkpointed resume token, or nil if there isn't one
+func readResumeToken(store Storage, table config.Table) (bson.M, error) {
+	data, err := store.read(formatResumeTokenFilename(table))
+	if err == errFileNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	token := bson.M{}
+	if err := bson.UnmarshalExtJSON(data, true, &token); err != nil {
+		return nil, fmt.Errorf("invalid resume token %s: %s", formatResumeTokenFilename(table), err)
+	}
+	return token, nil
+}
+
+// checkpoint saves the resume token once everything before it has been uploaded
+func checkpoint(store Storage, table config.Table, token bson.Raw) error {
+	data, err := bson.MarshalExtJSON(token, true, false)
+	if err != nil {
+		return err
+	}
+	if _, err := uploadFile(bytes.NewReader(data), store, formatResumeTokenFilename(table)); err != nil {
+		return err
+	}
+	log.InfoD("resume-token-checkpointed", logger.M{"collection": table.Destination})
+	return nil
+}
+
+// runChangeStream exports change events on the table's collection until ctx is cancelled,
+// at which point the open bucket is flushed before returning. If the stream fails, the
+// files of the open bucket are deleted.
+func runChangeStream(ctx context.Context, db *mongo.Database, run exportRun, table config.Table, interval time.Duration) error {
+	// the aborter isn't cancelled with ctx, since the open bucket is still written after it is
+	a := newRunAborter(context.Background())
+	defer a.stop()
+	if err := streamChanges(ctx, a, db, run, table, interval); err != nil {
+		a.fail(err)
+		a.cleanup()
+		return a.err()
+	}
+	return nil
+}
+
+func streamChanges(ctx context.Context, a *runAborter, db *mongo.Database, run exportRun, table config.Table, interval time.Duration) error {
+	store := run.tableStorage(table)
+	if table.Meta.OperationColumn == "" {
+		return &ConfigError{Table: table.Destination, Err: fmt.Errorf("cdc mode requires meta.operation_column")}
+	}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	token, err := readResumeToken(store, table)
+	if err != nil {
+		return &StorageError{URL: store.url(formatResumeTokenFilename(table)), Err: err}
+	}
+	if token != nil {
+		log.InfoD("change-stream-resume", logger.M{"collection": table.Destination})
+		opts.SetResumeAfter(token)
+	} else {
+		log.InfoD("change-stream-start", logger.M{"collection": table.Destination})
+	}
+
+	stream, err := db.Collection(table.Source).Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return &ReadError{Table: table.Destination, Err: err}
+	}
+	defer stream.Close(context.Background())
+
+	stats := config.NewCoercionStats()
+	var current *cdcBucket
+	defer func() {
+		// the open bucket's file isn't finished if the stream fails
+		if current != nil {
+			current.source.end()
+		}
+	}()
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		if err := current.finish(a, run, store, table.Destination); err != nil {
+			return err
+		}
+		if err := checkpoint(store, table, stream.ResumeToken()); err != nil {
+			return err
+		}
+		for column, count := range stats.Failures() {
+			log.WarnD("coercion-failures", logger.M{"collection": table.Destination, "column": column, "count": count})
+		}
+		current = nil
+		return nil
+	}
+
+	for {
+		if err := a.err(); err != nil {
+			return err
+		}
+		if current != nil && !time.Now().Before(current.closesAt) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		// TryNext returns false once the server has no more events for now, which gives us
+		// a chance to close buckets even when the collection is quiet
+		if !stream.TryNext(ctx) {
+			if ctx.Err() != nil {
+				log.Info("change-stream-shutdown")
+				return flush()
+			}
+			if err := stream.Err(); err != nil {
+				return &ReadError{Table: table.Destination, Err: err}
+			}
+			continue
+		}
+
+		var ev changeEvent
+		if err := stream.Decode(&ev); err != nil {
+			return &ReadError{Table: table.Destination, Err: err}
+		}
+		switch ev.OperationType {
+		case "insert", "update", "replace", "delete":
+		case "invalidate":
+			if err := flush(); err != nil {
+				return err
+			}
+			return &ReadError{Table: table.Destination, Err: fmt.Errorf("change stream on %s was invalidated", table.Source)}
+		default:
+			continue
+		}
+
+		if current == nil {
+			now := time.Now().UTC()
+			if current, err = openCDCBucket(a, run, table, now.Truncate(interval), interval, stats); err != nil {
+				return err
+			}
+		}
+		current.source.send(changeEventRow(ev))
+	}
+}
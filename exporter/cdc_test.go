@@ -0,0 +1,41 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+func TestNormalizeDocument(t *testing.T) {
+	created := time.Date(2016, 1, 27, 21, 0, 0, 0, time.UTC)
+	row := normalizeDocument(bson.M{
+		"created": primitive.NewDateTimeFromTime(created),
+		"name":    primitive.M{"first": "foo"},
+		"tags":    primitive.A{"a", primitive.M{"b": "c"}},
+	})
+	assert.Equal(t, optimus.Row{
+		"created": created,
+		"name":    map[string]interface{}{"first": "foo"},
+		"tags":    []interface{}{"a", map[string]interface{}{"b": "c"}},
+	}, row)
+}
+
+func TestChangeEventRow(t *testing.T) {
+	row := changeEventRow(changeEvent{
+		OperationType: "update",
+		FullDocument:  bson.M{"_id": "1", "name": "foo"},
+		DocumentKey:   bson.M{"_id": "1"},
+	})
+	assert.Equal(t, optimus.Row{"_id": "1", "name": "foo", config.OperationTypeKey: "update"}, row)
+
+	row = changeEventRow(changeEvent{
+		OperationType: "delete",
+		DocumentKey:   bson.M{"_id": "1"},
+	})
+	assert.Equal(t, optimus.Row{"_id": "1", config.OperationTypeKey: "delete"}, row)
+}
@@ -0,0 +1,120 @@
+package exporter
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// checksumAlgorithm is an algorithm S3 can check uploads with
+type checksumAlgorithm struct {
+	// name is what manifests call the digests
+	name    string
+	s3Name  string
+	newHash func() hash.Hash
+}
+
+var checksumAlgorithms = map[string]checksumAlgorithm{
+	"sha256": {name: "sha256", s3Name: s3.ChecksumAlgorithmSha256, newHash: sha256.New},
+	"crc32c": {name: "crc32c", s3Name: s3.ChecksumAlgorithmCrc32c, newHash: func() hash.Hash {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}},
+}
+
+// s3Fields returns the values of the SHA256 and CRC32C checksum members of a request, with
+// sum as the algorithm's and the other nil
+func (a checksumAlgorithm) s3Fields(sum string) (sha256, crc32c *string) {
+	if a.s3Name == s3.ChecksumAlgorithmCrc32c {
+		return nil, aws.String(sum)
+	}
+	return aws.String(sum), nil
+}
+
+// base64Sum returns what has been written to h, base64 encoded the way S3 reports checksums
+func base64Sum(h hash.Hash) string {
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// DefaultChecksum is the algorithm of runs that don't pick one
+const DefaultChecksum = "sha256"
+
+// digest is the checksum of a whole written object, as manifests record it
+type digest struct {
+	algorithm string
+	// value is hex encoded
+	value string
+}
+
+// digest returns the digest of what has been written to h
+func (a checksumAlgorithm) digest(h hash.Hash) digest {
+	return digest{algorithm: a.name, value: hex.EncodeToString(h.Sum(nil))}
+}
+
+// objectChecksum hashes an object as it is written. S3 checksums objects uploaded in
+// several parts by the checksum of their parts' checksums, so the parts are hashed too.
+type objectChecksum struct {
+	algorithm checksumAlgorithm
+	partSize  int64
+	whole     hash.Hash
+	part      hash.Hash
+	partBytes int64
+	// partSums are the checksums of the finished parts, one after the other
+	partSums []byte
+	parts    int
+	size     int64
+}
+
+func newObjectChecksum(algorithm checksumAlgorithm, partSize int64) *objectChecksum {
+	return &objectChecksum{
+		algorithm: algorithm,
+		partSize:  partSize,
+		whole:     algorithm.newHash(),
+		part:      algorithm.newHash(),
+	}
+}
+
+func (c *objectChecksum) Write(p []byte) (int, error) {
+	n := len(p)
+	c.whole.Write(p)
+	c.size += int64(n)
+	for len(p) > 0 {
+		// parts are only finished once there is more data, so that the last part is never empty
+		if c.partBytes == c.partSize {
+			c.partSums = append(c.partSums, c.part.Sum(nil)...)
+			c.parts++
+			c.part.Reset()
+			c.partBytes = 0
+		}
+		chunk := p
+		if remaining := c.partSize - c.partBytes; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		c.part.Write(chunk)
+		c.partBytes += int64(len(chunk))
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// digest returns the digest of the whole object
+func (c *objectChecksum) digest() digest {
+	return c.algorithm.digest(c.whole)
+}
+
+// s3Checksum returns the checksum S3 reports for the object. Objects of at most one part
+// are uploaded in one request, and anything else in parts of exactly partSize.
+func (c *objectChecksum) s3Checksum() string {
+	if c.parts == 0 {
+		return base64Sum(c.whole)
+	}
+	h := c.algorithm.newHash()
+	h.Write(c.partSums)
+	h.Write(c.part.Sum(nil))
+	return fmt.Sprintf("%s-%d", base64Sum(h), c.parts+1)
+}
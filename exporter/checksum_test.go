@@ -0,0 +1,56 @@
+package exporter
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectChecksumSinglePart(t *testing.T) {
+	checksum := newObjectChecksum(checksumAlgorithms["sha256"], 8)
+	checksum.Write([]byte("abc"))
+	checksum.Write([]byte("de"))
+
+	sum := sha256.Sum256([]byte("abcde"))
+	assert.Equal(t, digest{algorithm: "sha256", value: hex.EncodeToString(sum[:])}, checksum.digest())
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), checksum.s3Checksum())
+	assert.Equal(t, int64(5), checksum.size)
+}
+
+func TestObjectChecksumMultipart(t *testing.T) {
+	data := strings.Repeat("0123456789", 3) // parts of 8, 8, 8 and 6 bytes
+	checksum := newObjectChecksum(checksumAlgorithms["sha256"], 8)
+	// writes don't line up with the parts
+	checksum.Write([]byte(data[:5]))
+	checksum.Write([]byte(data[5:21]))
+	checksum.Write([]byte(data[21:]))
+
+	partSums := []byte{}
+	for _, part := range []string{data[:8], data[8:16], data[16:24], data[24:]} {
+		sum := sha256.Sum256([]byte(part))
+		partSums = append(partSums, sum[:]...)
+	}
+	sum := sha256.Sum256(partSums)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:])+"-4", checksum.s3Checksum())
+	whole := sha256.Sum256([]byte(data))
+	assert.Equal(t, hex.EncodeToString(whole[:]), checksum.digest().value)
+}
+
+func TestObjectChecksumWholeParts(t *testing.T) {
+	// objects of exactly one part are uploaded in one request
+	checksum := newObjectChecksum(checksumAlgorithms["crc32c"], 4)
+	checksum.Write([]byte("abcd"))
+
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	crc.Write([]byte("abcd"))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(crc.Sum(nil)), checksum.s3Checksum())
+	assert.Equal(t, digest{algorithm: "crc32c", value: hex.EncodeToString(crc.Sum(nil))}, checksum.digest())
+
+	checksum.Write([]byte("efgh"))
+	assert.True(t, strings.HasSuffix(checksum.s3Checksum(), "-2"))
+}
@@ -0,0 +1,99 @@
+package exporter
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// codec compresses the files of text formats
+type codec struct {
+	extension string
+	// copyOption is the COPY option s3-to-redshift loads the files with
+	copyOption string
+	// noCopy is set for codecs Redshift can't load, like lz4, whose files are only for
+	// other consumers
+	noCopy bool
+	// defaultLevel is used when the table doesn't set a level. 0 is the library's default.
+	defaultLevel int
+	newWriter    func(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+var codecs = map[string]codec{
+	"gzip": {extension: ".gz", copyOption: "GZIP", defaultLevel: gzip.BestSpeed, newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, level)
+	}},
+	"zstd": {extension: ".zst", copyOption: "ZSTD", newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}},
+	"bzip2": {extension: ".bz2", copyOption: "BZIP2", newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+		return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+	}},
+	"lz4": {extension: ".lz4", noCopy: true, newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+		writer := lz4.NewWriter(w)
+		if level == 0 {
+			return writer, nil
+		}
+		levels := []lz4.CompressionLevel{lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4,
+			lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+		return writer, writer.Apply(lz4.CompressionLevelOption(levels[level]))
+	}},
+	"none": {newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	}},
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// tableCodec returns the codec the table's files are compressed with, and whether they are
+// compressed by it at all rather than by their format
+func tableCodec(t config.Table) (codec, bool) {
+	c, ok := codecs[t.Meta.Codec()]
+	return c, ok
+}
+
+// compressedSink wraps a sink so that what it writes is compressed with the codec at the
+// table's level
+func compressedSink(c codec, t config.Table, w io.Writer, newSink func(config.Table, io.Writer) optimus.Sink) optimus.Sink {
+	level := t.Meta.CompressionLevel
+	if level == 0 {
+		level = c.defaultLevel
+	}
+	return func(source optimus.Table) error {
+		compressedOutput, err := c.newWriter(w, level)
+		if err != nil {
+			source.Stop()
+			return err
+		}
+		if err := newSink(t, compressedOutput)(source); err != nil {
+			return err
+		}
+		// ALWAYS close the compressor before the output, so that everything is flushed
+		return compressedOutput.Close()
+	}
+}
+
+// withRunCompression applies the run's compression flags to a table whose files are
+// compressed by a codec, unless the table sets its own
+func withRunCompression(t config.Table, compression string, level int) (config.Table, error) {
+	if t.Meta.Codec() == "" || t.Meta.Compression != "" {
+		return t, nil
+	}
+	t.Meta.Compression = compression
+	if t.Meta.CompressionLevel == 0 {
+		t.Meta.CompressionLevel = level
+	}
+	return t, t.Validate()
+}
@@ -0,0 +1,74 @@
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/Clever/optimus.v3"
+	"gopkg.in/Clever/optimus.v3/sources/slice"
+)
+
+func TestDataFileExtension(t *testing.T) {
+	tests := map[string]config.Meta{
+		".json.gz":  {},
+		".json.zst": {Compression: "zstd"},
+		".csv.bz2":  {Format: "csv", Compression: "bzip2"},
+		".tsv.lz4":  {Format: "tsv", Compression: "lz4"},
+		".json":     {Compression: "none"},
+		".parquet":  {Format: "parquet", Compression: "zstd"},
+		".avro":     {Format: "avro"},
+	}
+	for extension, meta := range tests {
+		assert.Equal(t, extension, dataFileExtension(config.Table{Meta: meta}), "%#v", meta)
+	}
+}
+
+func TestCompressedSink(t *testing.T) {
+	rows := []optimus.Row{{"id": "1"}, {"id": "2"}}
+	expected := "{\"id\":\"1\"}\n{\"id\":\"2\"}\n"
+
+	out := &bytes.Buffer{}
+	table := config.Table{Meta: config.Meta{CompressionLevel: 9}}
+	assert.NoError(t, newDataFileSink(table, out)(slice.New(rows)))
+	reader, err := gzip.NewReader(out)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(data))
+
+	out = &bytes.Buffer{}
+	table = config.Table{Meta: config.Meta{Compression: "zstd"}}
+	assert.NoError(t, newDataFileSink(table, out)(slice.New(rows)))
+	decoder, err := zstd.NewReader(out)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(decoder)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(data))
+
+	out = &bytes.Buffer{}
+	table = config.Table{Meta: config.Meta{Compression: "none"}}
+	assert.NoError(t, newDataFileSink(table, out)(slice.New(rows)))
+	assert.Equal(t, expected, out.String())
+}
+
+func TestWithRunCompression(t *testing.T) {
+	table, err := withRunCompression(config.Table{}, "zstd", 19)
+	assert.NoError(t, err)
+	assert.Equal(t, config.Meta{Compression: "zstd", CompressionLevel: 19}, table.Meta)
+
+	// tables that set their own codec, or whose format compresses itself, keep theirs
+	table, err = withRunCompression(config.Table{Meta: config.Meta{Compression: "bzip2"}}, "zstd", 19)
+	assert.NoError(t, err)
+	assert.Equal(t, config.Meta{Compression: "bzip2"}, table.Meta)
+	table, err = withRunCompression(config.Table{Meta: config.Meta{Format: "parquet"}}, "zstd", 19)
+	assert.NoError(t, err)
+	assert.Equal(t, config.Meta{Format: "parquet"}, table.Meta)
+
+	_, err = withRunCompression(config.Table{}, "gzip", 19)
+	assert.Error(t, err)
+}
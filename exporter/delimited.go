@@ -0,0 +1,117 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// delimitedEncoder formats rows as csv or tsv lines with the columns in the order the table
+// declares them. Fields are quoted the way Redshift's CSV COPY option expects: wrapped in
+// double quotes, with any double quotes inside doubled.
+type delimitedEncoder struct {
+	columns   []string
+	delimiter string
+	nullAs    string
+	quoteAll  bool
+	newlines  string
+}
+
+func newDelimitedEncoder(t config.Table, delimiter string) delimitedEncoder {
+	columns := []string{}
+	for _, field := range t.Columns() {
+		columns = append(columns, field.Destination)
+	}
+	return delimitedEncoder{
+		columns:   columns,
+		delimiter: delimiter,
+		nullAs:    t.Meta.NullAs,
+		quoteAll:  t.Meta.QuoteAll,
+		newlines:  t.Meta.Newlines,
+	}
+}
+
+// header returns the line of column names
+func (e delimitedEncoder) header() string {
+	fields := []string{}
+	for _, column := range e.columns {
+		fields = append(fields, e.field(column))
+	}
+	return strings.Join(fields, e.delimiter) + "\n"
+}
+
+// line returns the row's fields joined by the delimiter
+func (e delimitedEncoder) line(row optimus.Row) string {
+	fields := []string{}
+	for _, column := range e.columns {
+		val := row[column]
+		if val == nil {
+			fields = append(fields, e.nullAs)
+			continue
+		}
+		fields = append(fields, e.field(delimitedString(val)))
+	}
+	return strings.Join(fields, e.delimiter) + "\n"
+}
+
+// field quotes and escapes a value as needed
+func (e delimitedEncoder) field(s string) string {
+	switch e.newlines {
+	case "escape":
+		s = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n").Replace(s)
+	case "strip":
+		s = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(s)
+	}
+	// values that look like the null marker are quoted so that they aren't read as null
+	needsQuotes := e.quoteAll || s == e.nullAs || s != strings.TrimSpace(s) ||
+		strings.Contains(s, e.delimiter) || strings.ContainsAny(s, "\"\r\n")
+	if !needsQuotes {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// delimitedString formats a coerced value. Timestamps and dates are already strings.
+func delimitedString(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(val)
+}
+
+// delimitedSink returns a sink that writes the rows as lines with the delimiter
+func delimitedSink(delimiter string) func(t config.Table, w io.Writer) optimus.Sink {
+	return func(t config.Table, w io.Writer) optimus.Sink {
+		encoder := newDelimitedEncoder(t, delimiter)
+		return func(source optimus.Table) error {
+			defer source.Stop()
+			buffered := bufio.NewWriter(w)
+			if t.Meta.Header {
+				if _, err := buffered.WriteString(encoder.header()); err != nil {
+					return err
+				}
+			}
+			for row := range source.Rows() {
+				if _, err := buffered.WriteString(encoder.line(row)); err != nil {
+					return err
+				}
+			}
+			if err := source.Err(); err != nil {
+				return err
+			}
+			return buffered.Flush()
+		}
+	}
+}
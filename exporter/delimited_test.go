@@ -0,0 +1,41 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+var delimitedTable = config.Table{
+	Fields: []config.Field{
+		{Destination: "id", Type: "text"},
+		{Destination: "grade", Type: "int"},
+		{Destination: "name", Type: "text"},
+		{Destination: "active", Type: "boolean"},
+	},
+}
+
+func TestDelimitedEncoder(t *testing.T) {
+	e := newDelimitedEncoder(delimitedTable, ",")
+	assert.Equal(t, "id,grade,name,active\n", e.header())
+	// columns are always in the declared order
+	assert.Equal(t, "1,5,Alice,true\n", e.line(optimus.Row{"name": "Alice", "active": true, "id": "1", "grade": int64(5)}))
+	assert.Equal(t, "2,,\"Smith, \"\"Bob\"\"\",\n", e.line(optimus.Row{"id": "2", "grade": nil, "name": `Smith, "Bob"`, "active": nil}))
+	assert.Equal(t, "3,,\"line\nbreak\",\n", e.line(optimus.Row{"id": "3", "name": "line\nbreak"}))
+	// an empty string is quoted so it isn't loaded as null
+	assert.Equal(t, "4,,\"\",\n", e.line(optimus.Row{"id": "4", "name": ""}))
+}
+
+func TestDelimitedEncoderOptions(t *testing.T) {
+	table := delimitedTable
+	table.Meta = config.Meta{NullAs: `\N`, QuoteAll: true, Newlines: "escape"}
+	e := newDelimitedEncoder(table, "\t")
+	assert.Equal(t, "\"1\"\t\\N\t\"line\\nbreak\"\t\"false\"\n", e.line(optimus.Row{"id": "1", "name": "line\nbreak", "active": false}))
+
+	table.Meta = config.Meta{Newlines: "strip"}
+	e = newDelimitedEncoder(table, "\t")
+	assert.Equal(t, "1\t\tline break\t\n", e.line(optimus.Row{"id": "1", "name": "line\r\nbreak"}))
+	assert.Equal(t, "1\t\t\"tab\tbed\"\t\n", e.line(optimus.Row{"id": "1", "name": "tab\tbed"}))
+}
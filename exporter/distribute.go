@@ -0,0 +1,78 @@
+package exporter
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// partAssigner picks which of the output files a row goes to
+type partAssigner func(row optimus.Row) int
+
+// roundRobinAssigner deals rows out to the n files in turn. Rows are read in _id order, so
+// reruns over the same documents produce the same files.
+func roundRobinAssigner(n int) partAssigner {
+	next := 0
+	return func(row optimus.Row) int {
+		part := next
+		next = (next + 1) % n
+		return part
+	}
+}
+
+// hashAssigner assigns rows to the n files by the hash of a column, so that all of the
+// rows with the same value end up in the same file
+func hashAssigner(n int, column string) partAssigner {
+	return func(row optimus.Row) int {
+		h := fnv.New32a()
+		if val := row[column]; val != nil {
+			fmt.Fprint(h, val)
+		}
+		return int(h.Sum32() % uint32(n))
+	}
+}
+
+// tableAssigner returns the assigner for tables that distribute rows with one, or nil for
+// tables that read each file from its own _id range
+func tableAssigner(t config.Table, n int) partAssigner {
+	switch t.Meta.Distribution() {
+	case config.DistributeRoundRobin:
+		return roundRobinAssigner(n)
+	case config.DistributeHash:
+		return hashAssigner(n, t.DistributionKey())
+	}
+	return nil
+}
+
+// distributingSink sends each row on to the sink of the file assign picks for it
+func distributingSink(n int, assign partAssigner, newSink func(part int) optimus.Sink) optimus.Sink {
+	return func(source optimus.Table) error {
+		defer source.Stop()
+		parts := make([]*chanTable, n)
+		errs := make(chan error, n)
+		for i := range parts {
+			parts[i] = newChanTable()
+			go func(part *chanTable, sink optimus.Sink) {
+				errs <- sink(part)
+			}(parts[i], newSink(i))
+		}
+		for row := range source.Rows() {
+			parts[assign(row)].send(row)
+		}
+		for _, part := range parts {
+			close(part.rows)
+		}
+		var err error
+		for range parts {
+			if partErr := <-errs; partErr != nil && err == nil {
+				err = partErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return source.Err()
+	}
+}
@@ -0,0 +1,48 @@
+package exporter
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/Clever/optimus.v3"
+	"gopkg.in/Clever/optimus.v3/sources/slice"
+)
+
+func TestRoundRobinAssigner(t *testing.T) {
+	assign := roundRobinAssigner(3)
+	parts := []int{}
+	for i := 0; i < 7; i++ {
+		parts = append(parts, assign(optimus.Row{}))
+	}
+	assert.Equal(t, []int{0, 1, 2, 0, 1, 2, 0}, parts)
+}
+
+func TestHashAssigner(t *testing.T) {
+	assign := hashAssigner(4, "district_id")
+	for _, district := range []string{"a", "b", "c", "d", "e"} {
+		part := assign(optimus.Row{"district_id": district, "id": "1"})
+		assert.True(t, part >= 0 && part < 4)
+		// the same value always goes to the same file, whatever else is in the row
+		assert.Equal(t, part, assign(optimus.Row{"district_id": district, "id": "2"}))
+	}
+	assert.Equal(t, assign(optimus.Row{}), assign(optimus.Row{"district_id": nil}))
+}
+
+func TestDistributingSink(t *testing.T) {
+	rows := []optimus.Row{{"id": "1"}, {"id": "2"}, {"id": "3"}, {"id": "4"}, {"id": "5"}}
+	var mu sync.Mutex
+	received := map[int][]string{}
+	sink := distributingSink(2, roundRobinAssigner(2), func(part int) optimus.Sink {
+		return func(source optimus.Table) error {
+			for row := range source.Rows() {
+				mu.Lock()
+				received[part] = append(received[part], row["id"].(string))
+				mu.Unlock()
+			}
+			return nil
+		}
+	})
+	assert.NoError(t, sink(slice.New(rows)))
+	assert.Equal(t, map[int][]string{0: {"1", "3", "5"}, 1: {"2", "4"}}, received)
+}
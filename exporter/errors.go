@@ -0,0 +1,84 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrAborted is returned by exports whose context was cancelled. The files they wrote that
+// weren't committed have been deleted.
+var ErrAborted = errors.New("export aborted")
+
+// errNoDatabase is the error of exporters that need a database and weren't given one
+var errNoDatabase = errors.New("no database")
+
+// ConfigError is an invalid table or option
+type ConfigError struct {
+	// Table is the table's destination, if the error is about a table
+	Table string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("invalid config: %s", e.Err)
+	}
+	return fmt.Sprintf("invalid config for %s: %s", e.Table, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// ReadError is a failure to read the table's documents from mongo or to transform them
+type ReadError struct {
+	Table string
+	Err   error
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("reading %s: %s", e.Table, e.Err)
+}
+
+func (e *ReadError) Unwrap() error { return e.Err }
+
+// StorageError is a failure to write, read or move a file
+type StorageError struct {
+	// URL is the location of the file
+	URL string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("writing %s: %s", e.URL, e.Err)
+}
+
+func (e *StorageError) Unwrap() error { return e.Err }
+
+// RowCountError means that the rows written to files don't add up to the rows read
+// from mongo
+type RowCountError struct {
+	Table string
+	// Range is the index of the _id range whose rows don't add up, or -1 for the table's total
+	Range   int
+	Read    int64
+	Written int64
+}
+
+func (e *RowCountError) Error() string {
+	if e.Range < 0 {
+		return fmt.Sprintf("%s: wrote %d rows, but read %d", e.Table, e.Written, e.Read)
+	}
+	return fmt.Sprintf("%s: wrote %d rows of range %d, but read %d", e.Table, e.Written, e.Range, e.Read)
+}
+
+// CountError means that the rows read from mongo are outside of the documents it counted
+// for the export before and after reading them
+type CountError struct {
+	Table  string
+	Read   int64
+	Before int64
+	After  int64
+}
+
+func (e *CountError) Error() string {
+	return fmt.Sprintf("%s: read %d rows, but mongo counted %d before the export and %d after", e.Table, e.Read, e.Before, e.After)
+}
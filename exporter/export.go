@@ -0,0 +1,337 @@
+package exporter
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+	"gopkg.in/Clever/optimus.v3"
+	"gopkg.in/Clever/optimus.v3/transformer"
+	"gopkg.in/Clever/optimus.v3/transforms"
+)
+
+// exportRun is what the exports of every table in a run share
+type exportRun struct {
+	store   Storage
+	cluster string
+	// timestamp is the data date
+	timestamp string
+	runID     string
+	// keyLayout is the layout of tables that don't set their own
+	keyLayout string
+	// staged runs write data files to a staging prefix and publish them once they're done
+	staged   bool
+	numFiles int
+	limits   rollLimits
+}
+
+// tableStorage returns the run's storage, writing with the table's encryption if it sets one
+func (r exportRun) tableStorage(t config.Table) Storage {
+	if t.Meta.Encryption == nil {
+		return r.store
+	}
+	return r.store.withEncryption(*t.Meta.Encryption)
+}
+
+// exportTable exports a table's collection to files in the run's storage in the table's format, followed
+// by a manifest of the files and, for incremental tables, the new watermark. Goroutines
+// that fail stop the export through a, and the export returns the first error.
+func exportTable(a *runAborter, db *mongo.Database, run exportRun, sourceTable config.Table) (*Result, error) {
+	ctx := a.context()
+	store, timestamp, numFiles, limits := run.tableStorage(sourceTable), run.timestamp, run.numFiles, run.limits
+	keys, err := run.tableKeyNamer(sourceTable)
+	if err != nil {
+		return nil, &ConfigError{Table: sourceTable.Destination, Err: err}
+	}
+	extension := dataFileExtension(sourceTable)
+	if err := copySchemaFile(store, keys, sourceTable); err != nil {
+		return nil, err
+	}
+
+	// verify total rows match sum of written
+	var totalSummedRows int64
+	var totalMongoRows int64
+	coercionStats := config.NewCoercionStats()
+
+	// incremental tables only export the documents past the previous run's watermark
+	var query bson.M
+	var tracker *watermarkTracker
+	isIncremental := false
+	var previousWatermark []byte
+	if field := sourceTable.Meta.IncrementalField; field != "" {
+		var previous *watermark
+		previous, previousWatermark, err = readWatermark(store, sourceTable)
+		if err != nil {
+			return nil, &StorageError{URL: store.url(formatWatermarkFilename(sourceTable)), Err: err}
+		}
+		if previous != nil && previous.Field != field {
+			log.WarnD("watermark-field-changed", logger.M{"previous": previous.Field, "field": field})
+			previous = nil
+		}
+		if previous != nil {
+			query = previous.query()
+			isIncremental = true
+			log.InfoD("incremental-export", logger.M{"field": field, "watermark": previous.Value})
+		} else {
+			log.InfoD("incremental-export-no-watermark", logger.M{"field": field})
+		}
+		tracker = newWatermarkTracker(field, previous)
+	}
+
+	// the files each of the numFiles outputs of each partition rolled into, in the order they
+	// were started. Tables that aren't partitioned have just the "" partition.
+	outputParts := map[string][][]dataFile{}
+	var outputPartsMutex sync.Mutex
+	// Write output into pipes so that we don't need to store locally
+	openPart := func(partition string, index int) openPartFn {
+		partitionKeys := keys.partition(partition)
+		// partitions that were finished to make room for others carry on after the files
+		// they already wrote
+		outputPartsMutex.Lock()
+		firstPart := 0
+		if outputParts[partition] != nil {
+			firstPart = len(outputParts[partition][index])
+		}
+		outputPartsMutex.Unlock()
+		return func(part int) (io.Writer, func(int64)) {
+			part += firstPart
+			outputName := partitionKeys.key(limits.fileIndex(index, part), extension)
+			log.InfoD("outputting-file", logger.M{"file-number": index, "part": part, "location": outputName})
+			reader, writer := a.pipe()
+			// the file is deleted if the export fails before it is committed
+			a.track(store, run.stagingKey(outputName), outputName)
+			// Upload file to storage
+			// need to put in own goroutine to kick off because the sink can't write and the reader
+			// can't close until we hook up the reader to a sink via uploadFile
+			uploaded := make(chan struct{})
+			var fileDigest digest
+			done := a.startUpload()
+			go func() {
+				defer close(uploaded)
+				defer done()
+				var err error
+				if fileDigest, err = uploadFile(reader, store, run.stagingKey(outputName)); err != nil {
+					// failing closes the export's pipes, which stops the rows being written to them
+					a.fail(err)
+					reader.CloseWithError(err)
+				}
+			}()
+			return writer, func(contentLength int64) {
+				writer.Close()
+				<-uploaded
+				a.release(writer)
+				outputPartsMutex.Lock()
+				defer outputPartsMutex.Unlock()
+				if outputParts[partition] == nil {
+					outputParts[partition] = make([][]dataFile, numFiles)
+				}
+				outputParts[partition][index] = append(outputParts[partition][index], dataFile{Name: outputName, ContentLength: contentLength, Digest: fileDigest})
+			}
+		}
+	}
+
+	// tables that distribute rows by round robin or hash read them all with one cursor,
+	// otherwise each range of _ids is read by its own cursor and written to its own files, so
+	// that reading from mongo is parallelized along with the encoding and uploading
+	distributed := tableAssigner(sourceTable, numFiles) != nil
+	newSink := func(partition string, index int) optimus.Sink {
+		if !distributed {
+			return rollingSink(sourceTable, limits, openPart(partition, index))
+		}
+		// rows are assigned to files after they are transformed, so that they can be
+		// hashed by their column values. Each partition deals out its own rows.
+		return distributingSink(numFiles, tableAssigner(sourceTable, numFiles), func(part int) optimus.Sink {
+			return rollingSink(sourceTable, limits, openPart(partition, part))
+		})
+	}
+	partition := tablePartitioner(sourceTable)
+	ranges := []idRange{{}}
+	if !distributed {
+		ranges, err = splitIDRanges(ctx, db.Collection(sourceTable.Source), query, numFiles)
+		if err != nil {
+			return nil, &ReadError{Table: sourceTable.Destination, Err: err}
+		}
+	}
+	// mongo's count is what the rows read are checked against
+	counted, err := countDocuments(ctx, db, sourceTable, query)
+	if err != nil {
+		return nil, &ReadError{Table: sourceTable.Destination, Err: err}
+	}
+	rangeReadRows := make([]int64, len(ranges))
+	rangeWrittenRows := make([]int64, len(ranges))
+
+	var waitGroup sync.WaitGroup
+	for i, idRange := range ranges {
+		log.InfoD("reading-range", logger.M{"range": i, "min": idRange.Min, "max": idRange.Max})
+
+		// the driver gives each cursor its own pooled connection, so they don't wait on each other
+		mongoSource, err := configuredOptimusTable(ctx, db, sourceTable, idRange.query(query), 0)
+		if err != nil {
+			a.fail(&ReadError{Table: sourceTable.Destination, Err: err})
+			break
+		}
+		mongoSource = optimus.Transform(mongoSource, transforms.Each(func(index int) func(d optimus.Row) error {
+			return func(d optimus.Row) error {
+				rangeReadRows[index]++
+				if total := atomic.AddInt64(&totalMongoRows, 1); total%1000000 == 0 {
+					log.InfoD("processing-mongo-row", logger.M{"numRows": total})
+				}
+				if tracker != nil {
+					tracker.observe(d)
+				}
+				return nil
+			}
+		}(i)))
+
+		sink := newSink("", i)
+		if partition != nil {
+			sink = partitioningSink(partition, openPartitionsPerRange(numFiles), func(index int) func(string) optimus.Sink {
+				return func(p string) optimus.Sink { return newSink(p, index) }
+			}(i))
+		}
+		waitGroup.Add(1)
+		go func(index int) {
+			defer waitGroup.Done()
+			count, err := exportData(mongoSource, sourceTable, sink, timestamp, coercionStats)
+			if err != nil {
+				a.fail(&ReadError{Table: sourceTable.Destination, Err: err})
+				return
+			}
+			log.InfoD("output-destination", logger.M{"collection": sourceTable.Destination, "count": count, "range": index})
+			rangeWrittenRows[index] = int64(count)
+			// need to do this atomically to avoid concurrency issues
+			atomic.AddInt64(&totalSummedRows, int64(count))
+		}(i)
+	}
+	waitGroup.Wait()
+	if err := a.err(); err != nil {
+		return nil, err
+	}
+	partitionFiles := map[string][]dataFile{}
+	outputFiles := []dataFile{}
+	for partition, parts := range outputParts {
+		for _, files := range parts {
+			partitionFiles[partition] = append(partitionFiles[partition], files...)
+		}
+	}
+	for _, partition := range sortedPartitions(partitionFiles) {
+		outputFiles = append(outputFiles, partitionFiles[partition]...)
+	}
+	log.InfoD("output-total", logger.M{"rows": totalSummedRows, "files": len(outputFiles)})
+	for column, count := range coercionStats.Failures() {
+		log.WarnD("coercion-failures", logger.M{"collection": sourceTable.Destination, "column": column, "count": count})
+	}
+	for i := range ranges {
+		if rangeReadRows[i] != rangeWrittenRows[i] {
+			return nil, &RowCountError{Table: sourceTable.Destination, Range: i, Read: rangeReadRows[i], Written: rangeWrittenRows[i]}
+		}
+	}
+	if totalSummedRows != totalMongoRows {
+		return nil, &RowCountError{Table: sourceTable.Destination, Range: -1, Read: totalMongoRows, Written: totalSummedRows}
+	}
+	if err := reconcileCount(sourceTable.Destination, totalMongoRows, counted, func() (int64, error) {
+		return countDocuments(ctx, db, sourceTable, query)
+	}); err != nil {
+		return nil, err
+	}
+	// the counts reconcile, so the files can be moved into place
+	if err := publishFiles(run, store, outputFiles); err != nil {
+		return nil, err
+	}
+	// we always upload a manifest including the files we just created, or one in each
+	// partition's prefix of the partition's files
+	manifests := map[string][]dataFile{"": outputFiles}
+	if sourceTable.Meta.PartitionManifest == config.ManifestPartition {
+		manifests = partitionFiles
+	}
+	manifestFilenames := []string{}
+	for _, partition := range sortedPartitions(manifests) {
+		manifestFilename := keys.partition(partition).key("", ".manifest")
+		manifestReader, err := createManifest(store, manifests[partition])
+		if err != nil {
+			return nil, err
+		}
+		a.track(store, manifestFilename)
+		if _, err := uploadFile(manifestReader, store, manifestFilename); err != nil {
+			return nil, err
+		}
+		manifestFilenames = append(manifestFilenames, manifestFilename)
+	}
+
+	// the commit marker comes after the files it lists, so that consumers can trust any
+	// export that has one
+	markerFilename := commitMarkerKey(run, keys)
+	a.track(store, markerFilename)
+	if err := writeCommitMarker(run, store, markerFilename, sourceTable.Destination, totalSummedRows, manifestFilenames, outputFiles); err != nil {
+		return nil, err
+	}
+
+	// the watermark only moves once the export it covers is committed, and it's the last
+	// write, so that a failed export leaves the previous one in place
+	var moved *watermarkMove
+	if tracker != nil {
+		if mark := tracker.watermark(); mark != nil {
+			data, err := marshalWatermark(mark)
+			if err != nil {
+				return nil, err
+			}
+			moved = &watermarkMove{key: formatWatermarkFilename(sourceTable), previous: previousWatermark}
+			if _, err := uploadFile(bytes.NewReader(data), store, moved.key); err != nil {
+				return nil, err
+			}
+			log.InfoD("watermark-updated", logger.M{"field": mark.Field, "watermark": mark.Value})
+		}
+	}
+	a.forget(store, markerFilename)
+	a.forget(store, manifestFilenames...)
+	for _, f := range outputFiles {
+		a.forget(store, run.stagingKey(f.Name), f.Name)
+	}
+
+	result := &Result{
+		Table:       sourceTable.Destination,
+		Rows:        totalSummedRows,
+		Incremental: isIncremental,
+		Format:      sourceTable.Meta.OutputFormat(),
+		watermark:   moved,
+	}
+	for _, f := range outputFiles {
+		result.Files = append(result.Files, File{
+			URL:             store.url(f.Name),
+			ContentLength:   f.ContentLength,
+			DigestAlgorithm: f.Digest.algorithm,
+			Digest:          f.Digest.value,
+		})
+	}
+	for _, manifest := range manifestFilenames {
+		result.Manifests = append(result.Manifests, store.url(manifest))
+	}
+	if c, ok := tableCodec(sourceTable); ok {
+		result.Compression = c.copyOption
+	}
+	return result, nil
+}
+
+func exportData(source optimus.Table, table config.Table, sink optimus.Sink, timestamp string, stats *config.CoercionStats) (int, error) {
+	rows := 0
+	datePopulator := config.GetPopulateDateFn(table.Meta.DataDateColumn, timestamp)
+	existentialTransformer := config.GetExistentialTransformerFn(table)
+	coercer := config.GetCoercionFn(table, stats)
+	schemaEnforcer := config.GetSchemaEnforcerFn(table)
+	err := transformer.New(source).Map(config.Flattener()).
+		Map(existentialTransformer). // convert PII to boolean exists or not
+		Fieldmap(table.FieldMap()).
+		Map(datePopulator).  // add in the _data_timestamp, etc
+		Map(coercer).        // convert values to their column type
+		Map(schemaEnforcer). // emit exactly the declared columns
+		Map(func(d optimus.Row) (optimus.Row, error) {
+			rows = rows + 1
+			return d, nil
+		}).Sink(sink)
+	return rows, err
+}
@@ -0,0 +1,273 @@
+// Package exporter exports mongo collections to files in S3 or a local directory, along
+// with the manifests that s3-to-redshift loads them with.
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+var log = logger.New("mongo-to-s3")
+
+// SetLogOutput sends the package's logs to w, e.g. to keep stdout for a command's output
+func SetLogOutput(w io.Writer) {
+	log.SetOutput(w)
+}
+
+// Exporter exports a table of the config
+type Exporter struct {
+	db    *mongo.Database
+	table *config.Table
+	// format, compression and compressionLevel override the table's
+	format           string
+	compression      string
+	compressionLevel int
+	// load is set when the files are loaded into Redshift
+	load bool
+	run  exportRun
+}
+
+// Option configures an Exporter
+type Option func(e *Exporter)
+
+// WithDatabase sets the mongo database the table's collection is read from
+func WithDatabase(db *mongo.Database) Option {
+	return func(e *Exporter) { e.db = db }
+}
+
+// WithStorage sets the storage the files are written to
+func WithStorage(store Storage) Option {
+	return func(e *Exporter) { e.run.store = store }
+}
+
+// WithTable sets the table to export
+func WithTable(t config.Table) Option {
+	return func(e *Exporter) { e.table = &t }
+}
+
+// WithTimestamp sets the data date of the export, which the files are named after. It
+// defaults to RunTimestamp of the current time.
+func WithTimestamp(timestamp string) Option {
+	return func(e *Exporter) { e.run.timestamp = timestamp }
+}
+
+// WithFormat overrides the format of the table: json, parquet, csv, tsv or avro
+func WithFormat(format string) Option {
+	return func(e *Exporter) { e.format = format }
+}
+
+// WithCompression sets the codec and level of json, csv and tsv tables that don't set
+// their own
+func WithCompression(compression string, level int) Option {
+	return func(e *Exporter) { e.compression, e.compressionLevel = compression, level }
+}
+
+// WithRedshiftLoad sets whether the files are loaded into Redshift, which can't load every
+// codec's files. It defaults to false.
+func WithRedshiftLoad(load bool) Option {
+	return func(e *Exporter) { e.load = load }
+}
+
+// WithCluster sets the name of the cluster, which key layouts can use
+func WithCluster(cluster string) Option {
+	return func(e *Exporter) { e.run.cluster = cluster }
+}
+
+// WithRunID sets the ID of the run the export is part of. It defaults to RunID of the
+// current time.
+func WithRunID(runID string) Option {
+	return func(e *Exporter) { e.run.runID = runID }
+}
+
+// WithKeyLayout sets the layout of the keys of tables that don't set their own: redshift
+// (the default), hive, flat or a template
+func WithKeyLayout(layout string) Option {
+	return func(e *Exporter) { e.run.keyLayout = layout }
+}
+
+// WithStaging sets whether data files are written under a staging prefix and only moved
+// into place once the export has succeeded, which is the default
+func WithStaging(staged bool) Option {
+	return func(e *Exporter) { e.run.staged = staged }
+}
+
+// WithNumFiles sets how many files the table is split into. It defaults to 1.
+func WithNumFiles(n int) Option {
+	return func(e *Exporter) { e.run.numFiles = n }
+}
+
+// WithFileLimits rolls output over to a new file once the current one reaches maxBytes
+// compressed bytes or maxRows rows. 0 means no limit, which is the default.
+func WithFileLimits(maxBytes, maxRows int64) Option {
+	return func(e *Exporter) { e.run.limits = rollLimits{maxBytes: maxBytes, maxRows: maxRows} }
+}
+
+// RunTimestamp returns the data date of a run started at t, which is rounded down to the hour
+func RunTimestamp(t time.Time) string {
+	return t.UTC().Add(-1 * time.Hour / 2).Round(time.Hour).Format(time.RFC3339)
+}
+
+// RunID returns the ID of a run started at t
+func RunID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// newExporter applies the options over the defaults
+func newExporter(opts []Option) *Exporter {
+	now := time.Now()
+	e := &Exporter{run: exportRun{
+		timestamp: RunTimestamp(now),
+		runID:     RunID(now),
+		keyLayout: DefaultKeyLayout,
+		staged:    true,
+		numFiles:  1,
+	}}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// New returns an Exporter of the table. The database and storage are only needed once
+// exporting, so that a run can check its options before connecting and tables can be
+// previewed without writing anything. Invalid options return a ConfigError.
+func New(opts ...Option) (*Exporter, error) {
+	e := newExporter(opts)
+	if e.table == nil {
+		return nil, &ConfigError{Err: errors.New("no table")}
+	}
+	table := *e.table
+	if e.run.numFiles < 1 {
+		return nil, &ConfigError{Table: table.Destination, Err: fmt.Errorf("must export to at least 1 file, not %d", e.run.numFiles)}
+	}
+	if e.format != "" {
+		table.Meta.Format = e.format
+		if err := table.Validate(); err != nil {
+			return nil, &ConfigError{Table: table.Destination, Err: err}
+		}
+	}
+	table, err := withRunCompression(table, e.compression, e.compressionLevel)
+	if err != nil {
+		return nil, &ConfigError{Table: table.Destination, Err: err}
+	}
+	if c, ok := tableCodec(table); ok && c.noCopy && e.load {
+		return nil, &ConfigError{Table: table.Destination, Err: fmt.Errorf("redshift can't load %s files", table.Meta.Codec())}
+	}
+	if _, err := e.run.tableKeyNamer(table); err != nil {
+		return nil, &ConfigError{Table: table.Destination, Err: err}
+	}
+	e.table = &table
+	return e, nil
+}
+
+// File is a data file an export wrote
+type File struct {
+	URL           string `json:"url"`
+	ContentLength int64  `json:"content_length"`
+	// Digest is the hex encoded checksum of the file, by DigestAlgorithm
+	DigestAlgorithm string `json:"digest_algorithm,omitempty"`
+	Digest          string `json:"digest,omitempty"`
+}
+
+// Result is what an export wrote
+type Result struct {
+	// Table is the table's destination
+	Table string `json:"table"`
+	Files []File `json:"files"`
+	Rows  int64  `json:"rows"`
+	// Manifests has the url of the table's manifest, or of one for each partition of
+	// tables with partition manifests
+	Manifests []string `json:"manifests"`
+	// Incremental is set when only the documents past the previous watermark were exported
+	Incremental bool `json:"incremental"`
+	// Format is the files' format: json, parquet, csv, tsv or avro
+	Format string `json:"format"`
+	// Compression is the COPY option for the files' codec, empty if the format compresses
+	// them itself
+	Compression string `json:"compression"`
+	// watermark is the export's update of an incremental table's watermark
+	watermark *watermarkMove
+}
+
+// checkConnected checks that the exporter has the database and storage it needs to export
+func (e *Exporter) checkConnected() error {
+	if e.db == nil {
+		return &ConfigError{Table: e.table.Destination, Err: errNoDatabase}
+	}
+	if e.run.store == nil {
+		return &ConfigError{Table: e.table.Destination, Err: errors.New("no storage")}
+	}
+	return nil
+}
+
+// Export exports the table. If it fails, the files it wrote that weren't committed are
+// deleted and the error is returned: a ConfigError, ReadError, StorageError,
+// RowCountError or CountError, or ErrAborted if ctx was cancelled.
+func (e *Exporter) Export(ctx context.Context) (*Result, error) {
+	if err := e.checkConnected(); err != nil {
+		return nil, err
+	}
+	a := newRunAborter(ctx)
+	defer a.stop()
+	result, err := exportTable(a, e.db, e.run, *e.table)
+	if err != nil {
+		a.fail(err)
+		a.cleanup()
+		if ctx.Err() != nil {
+			return nil, ErrAborted
+		}
+		return nil, a.err()
+	}
+	return result, nil
+}
+
+// RestoreWatermark moves the watermark of an incremental table back to where it was before
+// the export of result, so that the next run exports the same documents again. It's for
+// runs that fail after some of their tables were exported, whose files won't be loaded.
+func (e *Exporter) RestoreWatermark(result *Result) error {
+	if result == nil || result.watermark == nil {
+		return nil
+	}
+	if err := result.watermark.restore(e.run.tableStorage(*e.table)); err != nil {
+		return err
+	}
+	log.InfoD("watermark-restored", logger.M{"collection": e.table.Destination})
+	return nil
+}
+
+// Stream exports the change events on the table's collection until ctx is cancelled, in
+// files that each hold interval's events. The open file is finished before returning.
+func (e *Exporter) Stream(ctx context.Context, interval time.Duration) error {
+	if err := e.checkConnected(); err != nil {
+		return err
+	}
+	return runChangeStream(ctx, e.db, e.run, *e.table, interval)
+}
+
+// CopyConfig uploads a copy of the config named name next to the tables of the run the
+// options describe, and returns its url. The copy is named like a table of the run's key
+// layout, in the default schema.
+func CopyConfig(name, data string, opts ...Option) (string, error) {
+	run := newExporter(opts).run
+	if run.store == nil {
+		return "", &ConfigError{Table: name, Err: errors.New("no storage")}
+	}
+	keys, err := newKeyNamer(run.keyLayout, newKeyVars(config.DefaultSchema, name, run.cluster, run.timestamp, run.runID))
+	if err != nil {
+		return "", &ConfigError{Table: name, Err: err}
+	}
+	key := keys.key("", ".yml")
+	log.InfoD("conf-file-upload", logger.M{"path": run.store.url(key)})
+	if _, err := uploadFile(strings.NewReader(data), run.store, key); err != nil {
+		return "", err
+	}
+	return run.store.url(key), nil
+}
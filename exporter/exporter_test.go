@@ -0,0 +1,75 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTimestamp(t *testing.T) {
+	now := time.Date(2016, 1, 27, 21, 30, 12, 0, time.UTC)
+	assert.Equal(t, "2016-01-27T21:00:00Z", RunTimestamp(now))
+	assert.Equal(t, "20160127T213012Z", RunID(now))
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	store := localStorage{dir: "/tmp/exports", checksum: checksumAlgorithms["sha256"]}
+	table := config.Table{Destination: "students", Source: "students"}
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"no table", []Option{WithStorage(store)}},
+		{"no files", []Option{WithTable(table), WithStorage(store), WithNumFiles(0)}},
+		{"unknown format", []Option{WithTable(table), WithStorage(store), WithFormat("xml")}},
+		{"unknown layout", []Option{WithTable(table), WithStorage(store), WithKeyLayout("athena")}},
+		{"lz4 load", []Option{WithTable(table), WithStorage(store), WithCompression("lz4", 0), WithRedshiftLoad(true)}},
+	}
+	for _, test := range tests {
+		_, err := New(test.opts...)
+		var configErr *ConfigError
+		assert.True(t, errors.As(err, &configErr), test.name)
+	}
+
+	// lz4 files are fine for runs that aren't loaded
+	_, err := New(WithTable(table), WithStorage(store), WithCompression("lz4", 0))
+	assert.NoError(t, err)
+
+	// the database and storage are only needed to export
+	e, err := New(WithTable(table), WithFormat(config.FormatCSV))
+	assert.NoError(t, err)
+	assert.Equal(t, config.FormatCSV, e.table.Meta.Format)
+	_, err = e.Export(context.Background())
+	var configErr *ConfigError
+	assert.True(t, errors.As(err, &configErr))
+}
+
+func TestCopyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongo-to-s3")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := localStorage{dir: dir, checksum: checksumAlgorithms["sha256"]}
+
+	url, err := CopyConfig("clever-db", "students: {}", WithStorage(store), WithTimestamp("2016-01-27T21:00:00Z"), WithKeyLayout("flat"))
+	assert.NoError(t, err)
+	assert.Equal(t, store.url("mongo_raw/clever-db/clever-db_2016-01-27T21:00:00Z.yml"), url)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "mongo_raw", "clever-db", "clever-db_2016-01-27T21:00:00Z.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "students: {}", string(data))
+}
+
+func TestErrors(t *testing.T) {
+	err := error(&StorageError{URL: "s3://bucket/a.json.gz", Err: errFileNotFound})
+	assert.True(t, errors.Is(err, errFileNotFound))
+	assert.Equal(t, "writing s3://bucket/a.json.gz: file not found", err.Error())
+	assert.Equal(t, "students: wrote 9 rows, but read 10", (&RowCountError{Table: "students", Range: -1, Read: 10, Written: 9}).Error())
+	assert.Equal(t, "students: read 9 rows, but mongo counted 10 before the export and 12 after", (&CountError{Table: "students", Read: 9, Before: 10, After: 12}).Error())
+	assert.Equal(t, "invalid config: no table", (&ConfigError{Err: errors.New("no table")}).Error())
+}
@@ -0,0 +1,136 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"gopkg.in/Clever/optimus.v3"
+	jsonsink "gopkg.in/Clever/optimus.v3/sinks/json"
+)
+
+// outputFormat is a file format tables can be exported in
+type outputFormat struct {
+	// extension is appended to the names of the data files, before the codec's
+	extension string
+	// newSink returns a sink that writes the table's rows to w
+	newSink func(t config.Table, w io.Writer) optimus.Sink
+	// schema returns the table's schema for formats that upload one next to the data files,
+	// with the name ending in schemaExtension
+	schema          func(t config.Table) ([]byte, error)
+	schemaExtension string
+}
+
+var outputFormats = map[string]outputFormat{
+	config.FormatJSON:    {extension: ".json", newSink: jsonSink},
+	config.FormatParquet: {extension: ".parquet", newSink: parquetSink},
+	config.FormatCSV:     {extension: ".csv", newSink: delimitedSink(",")},
+	config.FormatTSV:     {extension: ".tsv", newSink: delimitedSink("\t")},
+	config.FormatAvro:    {extension: ".avro", newSink: avroSink, schema: avroSchema, schemaExtension: ".avsc"},
+}
+
+// tableFormat returns the format the table is exported in. Validate has already checked
+// that it is one of outputFormats.
+func tableFormat(t config.Table) outputFormat {
+	return outputFormats[t.Meta.OutputFormat()]
+}
+
+// dataFileExtension returns the extension of the table's data files, e.g. .json.gz
+func dataFileExtension(t config.Table) string {
+	extension := tableFormat(t).extension
+	if c, ok := tableCodec(t); ok {
+		extension += c.extension
+	}
+	return extension
+}
+
+// newDataFileSink returns a sink that writes the table's rows to w in its format, compressed
+// with its codec
+func newDataFileSink(t config.Table, w io.Writer) optimus.Sink {
+	format := tableFormat(t)
+	if c, ok := tableCodec(t); ok {
+		return compressedSink(c, t, w, format.newSink)
+	}
+	return format.newSink(t, w)
+}
+
+// copySchemaFile uploads the table's schema next to its data files if its format has one,
+// so that consumers don't have to derive it from the config
+func copySchemaFile(store Storage, keys keyNamer, t config.Table) error {
+	format := tableFormat(t)
+	if format.schema == nil {
+		return nil
+	}
+	data, err := format.schema(t)
+	if err != nil {
+		return &ConfigError{Table: t.Destination, Err: err}
+	}
+	_, err = uploadFile(bytes.NewReader(data), store, keys.key("", format.schemaExtension))
+	return err
+}
+
+// columnRequired returns whether a column can be declared non-nullable in the schema of
+// a file. Delete rows from change streams only have their primary keys, so the other
+// columns of tables with an operation column have to be nullable even if they are notnull.
+func columnRequired(t config.Table, f config.Field) bool {
+	return f.NotNull && (f.PrimaryKey || t.Meta.OperationColumn == "")
+}
+
+// binaryValue converts a coerced value of the given base type to the go type that binary
+// formats store the column as. Timestamps are stored as microseconds since the epoch,
+// which is Redshift's precision, and dates as days since the epoch.
+func binaryValue(baseType string, val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	switch baseType {
+	case "int":
+		i, ok := val.(int64)
+		if !ok {
+			return nil, fmt.Errorf("expected an int64, got %T", val)
+		}
+		return int32(i), nil
+	case "timestamp":
+		s, _ := val.(string)
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return t.UnixNano() / int64(time.Microsecond), nil
+	case "date":
+		s, _ := val.(string)
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, err
+		}
+		return int32(t.Unix() / int64(24*time.Hour/time.Second)), nil
+	}
+	return val, nil
+}
+
+// jsonSink writes the rows as JSON, one object per line
+func jsonSink(t config.Table, w io.Writer) optimus.Sink {
+	return jsonsink.New(w)
+}
+
+// countingWriter counts the bytes written through it, so that the size of a file can be
+// put in its manifest without waiting for the upload to report it. The count can be read
+// while the file is still being written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// count returns the number of bytes written so far
+func (c *countingWriter) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
@@ -0,0 +1,30 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryValue(t *testing.T) {
+	tests := []struct {
+		baseType string
+		in       interface{}
+		out      interface{}
+	}{
+		{"int", int64(42), int32(42)},
+		{"bigint", int64(42), int64(42)},
+		{"timestamp", "2016-01-27T21:00:00.000001Z", int64(1453928400000001)},
+		{"date", "1970-01-11", int32(10)},
+		{"varchar", "foo", "foo"},
+		{"timestamp", nil, nil},
+	}
+	for _, test := range tests {
+		out, err := binaryValue(test.baseType, test.in)
+		assert.NoError(t, err)
+		assert.Equal(t, test.out, out, "%s %v", test.baseType, test.in)
+	}
+
+	_, err := binaryValue("timestamp", "yesterday")
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package exporter
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+)
+
+// keyLayouts are the named layouts of S3 keys. redshift is the layout s3-to-redshift
+// expects, hive partitions files by date and hour the way Athena and Spectrum do, and
+// flat puts all of a table's files under one prefix.
+var keyLayouts = map[string]string{
+	"redshift": "{{.Schema}}/{{.Table}}/_data_timestamp_year={{.Year}}/_data_timestamp_month={{.Month}}/_data_timestamp_day={{.Day}}/" +
+		"{{with .Partition}}{{.}}/{{end}}{{.Schema}}_{{.Table}}_{{.Timestamp}}{{with .Part}}_{{.}}{{end}}{{.Ext}}",
+	"hive": "{{.Schema}}/{{.Table}}/year={{.Year}}/month={{.Month}}/day={{.Day}}/hour={{.Hour}}/" +
+		"{{with .Partition}}{{.}}/{{end}}{{.Table}}_{{.RunID}}{{with .Part}}_{{.}}{{end}}{{.Ext}}",
+	"flat": "{{.Schema}}/{{.Table}}/{{with .Partition}}{{.}}/{{end}}{{.Table}}_{{.Timestamp}}{{with .Part}}_{{.}}{{end}}{{.Ext}}",
+}
+
+// DefaultKeyLayout is the layout of runs that don't set one
+const DefaultKeyLayout = "redshift"
+
+// keyVars are the variables key layouts can use
+type keyVars struct {
+	Schema  string
+	Table   string
+	Cluster string
+	// Timestamp is the data date, e.g. 2016-01-27T21:00:00Z, and Year, Month, Day and Hour
+	// are its zero-padded parts
+	Timestamp string
+	Year      string
+	Month     string
+	Day       string
+	Hour      string
+	// RunID is unique to each run, even of the same data date
+	RunID string
+	// Partition is the column and value of the partition a file holds, e.g. district_id=123,
+	// and empty for tables that aren't partitioned
+	Partition string
+	// Part is the index of a data file, and empty for manifests and schemas
+	Part string
+	// Ext is the file's extension, including the leading dot
+	Ext string
+}
+
+func newKeyVars(schema, table, cluster, timestamp, runID string) keyVars {
+	t, _ := time.Parse(time.RFC3339, timestamp)
+	return keyVars{
+		Schema:    schema,
+		Table:     table,
+		Cluster:   cluster,
+		Timestamp: timestamp,
+		Year:      fmt.Sprintf("%02d", t.Year()),
+		Month:     fmt.Sprintf("%02d", int(t.Month())),
+		Day:       fmt.Sprintf("%02d", t.Day()),
+		Hour:      fmt.Sprintf("%02d", t.Hour()),
+		RunID:     runID,
+	}
+}
+
+// keyNamer names the files of one export of a table
+type keyNamer struct {
+	layout *template.Template
+	vars   keyVars
+}
+
+// newKeyNamer returns a namer for the layout, which is either one of keyLayouts or a
+// template of keyVars
+func newKeyNamer(layout string, vars keyVars) (keyNamer, error) {
+	if named, ok := keyLayouts[layout]; ok {
+		layout = named
+	} else if !strings.Contains(layout, "{{") {
+		return keyNamer{}, fmt.Errorf("unknown key layout '%s'", layout)
+	}
+	tmpl, err := template.New("key").Parse(layout)
+	if err != nil {
+		return keyNamer{}, fmt.Errorf("invalid key layout: %s", err)
+	}
+	n := keyNamer{layout: tmpl, vars: vars}
+	// catch references to variables that don't exist before any files are written
+	if _, err := n.execute("0", ".json"); err != nil {
+		return keyNamer{}, fmt.Errorf("invalid key layout: %s", err)
+	}
+	return n, nil
+}
+
+func (n keyNamer) execute(part, extension string) (string, error) {
+	vars := n.vars
+	vars.Part = part
+	vars.Ext = extension
+	var key strings.Builder
+	err := n.layout.Execute(&key, vars)
+	return key.String(), err
+}
+
+// partition returns the namer for the files of one partition of the table
+func (n keyNamer) partition(partition string) keyNamer {
+	n.vars.Partition = partition
+	return n
+}
+
+// key returns the key of a file. part is empty for files that aren't data files.
+func (n keyNamer) key(part, extension string) string {
+	// the layout was checked by executing it in newKeyNamer, so it can't fail here
+	key, _ := n.execute(part, extension)
+	return key
+}
+
+// tableKeyNamer returns the namer for the run's files of a table, in the table's layout
+// or else the run's
+func (r exportRun) tableKeyNamer(t config.Table) (keyNamer, error) {
+	layout := t.Meta.KeyLayout
+	if layout == "" {
+		layout = r.keyLayout
+	}
+	n, err := newKeyNamer(layout, newKeyVars(t.Meta.SchemaName(), t.Destination, r.cluster, r.timestamp, r.runID))
+	if err != nil || t.Meta.PartitionColumn == "" {
+		return n, err
+	}
+	// otherwise every partition would write to the same keys
+	if n.partition("a=1").key("0", ".json") == n.partition("a=2").key("0", ".json") {
+		return keyNamer{}, fmt.Errorf("key layout of partitioned table %s doesn't use {{.Partition}}", t.Destination)
+	}
+	return n, nil
+}
@@ -0,0 +1,78 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyLayouts(t *testing.T) {
+	vars := newKeyVars("mongo_raw", "students", "clever-db", "2016-01-27T21:00:00Z", "20160127T213012Z")
+	tests := []struct {
+		layout string
+		part   string
+		ext    string
+		key    string
+	}{
+		{"redshift", "0", ".json.gz",
+			"mongo_raw/students/_data_timestamp_year=2016/_data_timestamp_month=01/_data_timestamp_day=27/mongo_raw_students_2016-01-27T21:00:00Z_0.json.gz"},
+		{"redshift", "", ".manifest",
+			"mongo_raw/students/_data_timestamp_year=2016/_data_timestamp_month=01/_data_timestamp_day=27/mongo_raw_students_2016-01-27T21:00:00Z.manifest"},
+		{"hive", "1_2", ".parquet",
+			"mongo_raw/students/year=2016/month=01/day=27/hour=21/students_20160127T213012Z_1_2.parquet"},
+		{"flat", "0", ".csv.gz", "mongo_raw/students/students_2016-01-27T21:00:00Z_0.csv.gz"},
+		{"{{.Cluster}}/{{.Table}}/dt={{.Year}}-{{.Month}}-{{.Day}}/{{.Part}}{{.Ext}}", "3", ".avro",
+			"clever-db/students/dt=2016-01-27/3.avro"},
+	}
+	for _, test := range tests {
+		keys, err := newKeyNamer(test.layout, vars)
+		assert.NoError(t, err, test.layout)
+		assert.Equal(t, test.key, keys.key(test.part, test.ext))
+	}
+}
+
+func TestPartitionKeys(t *testing.T) {
+	vars := newKeyVars("mongo_raw", "students", "clever-db", "2016-01-27T21:00:00Z", "20160127T213012Z")
+	keys, err := newKeyNamer("redshift", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo_raw/students/_data_timestamp_year=2016/_data_timestamp_month=01/_data_timestamp_day=27/district_id=123/mongo_raw_students_2016-01-27T21:00:00Z_0.json.gz",
+		keys.partition("district_id=123").key("0", ".json.gz"))
+	keys, err = newKeyNamer("flat", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo_raw/students/district_id=123/students_2016-01-27T21:00:00Z.manifest",
+		keys.partition("district_id=123").key("", ".manifest"))
+
+	// partitioned tables need layouts that put partitions in different places
+	run := exportRun{timestamp: "2016-01-27T21:00:00Z", keyLayout: "{{.Table}}/{{.Part}}{{.Ext}}"}
+	table := config.Table{Destination: "students", Meta: config.Meta{PartitionColumn: "district_id"}}
+	_, err = run.tableKeyNamer(table)
+	assert.Error(t, err)
+	run.keyLayout = "{{.Table}}/{{.Partition}}/{{.Part}}{{.Ext}}"
+	_, err = run.tableKeyNamer(table)
+	assert.NoError(t, err)
+}
+
+func TestInvalidKeyLayouts(t *testing.T) {
+	vars := newKeyVars("mongo_raw", "students", "clever-db", "2016-01-27T21:00:00Z", "20160127T213012Z")
+	for _, layout := range []string{"athena", "{{.Table", "{{.Collection}}/{{.Part}}"} {
+		_, err := newKeyNamer(layout, vars)
+		assert.Error(t, err, layout)
+	}
+}
+
+func TestTableKeyNamer(t *testing.T) {
+	run := exportRun{cluster: "clever-db", timestamp: "2016-01-27T21:00:00Z", runID: "20160127T213012Z", keyLayout: "flat"}
+	table := config.Table{Destination: "students"}
+
+	keys, err := run.tableKeyNamer(table)
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo_raw/students/students_2016-01-27T21:00:00Z.manifest", keys.key("", ".manifest"))
+
+	// the table's schema and layout take precedence over the run's
+	table.Meta.Schema = "athena_raw"
+	table.Meta.KeyLayout = "hive"
+	keys, err = run.tableKeyNamer(table)
+	assert.NoError(t, err)
+	assert.Equal(t, "athena_raw/students/year=2016/month=01/day=27/hour=21/students_20160127T213012Z_0.json.gz", keys.key("0", ".json.gz"))
+}
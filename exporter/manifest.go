@@ -0,0 +1,59 @@
+package exporter
+
+import (
+	"bytes"
+	"io"
+
+	json "github.com/pquerna/ffjson/ffjson"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// EntryArray is a convenience function for JSON marshalling
+type EntryArray []map[string]interface{}
+
+// Manifest represents an s3 manifest file used to download to redshift
+// really only useful for JSON marshalling
+type Manifest struct {
+	Entries EntryArray `json:"entries"`
+}
+
+// dataFile is an uploaded data file, along with its size in bytes and digest. Redshift
+// needs the sizes in the manifest to COPY columnar formats like parquet.
+type dataFile struct {
+	Name          string
+	ContentLength int64
+	Digest        digest
+}
+
+// manifestEntries returns the manifest entries of the files
+func manifestEntries(store Storage, dataFiles []dataFile) EntryArray {
+	var entryArray EntryArray
+	for _, f := range dataFiles {
+		meta := map[string]interface{}{"content_length": f.ContentLength}
+		if f.Digest.algorithm != "" {
+			meta[f.Digest.algorithm] = f.Digest.value
+		}
+		entryArray = append(entryArray, map[string]interface{}{
+			"url":       store.url(f.Name),
+			"mandatory": true,
+			"meta":      meta,
+		})
+	}
+	return entryArray
+}
+
+// createManifest creates a manifest file given the list of files to include into the file
+// it returns a reader for convenience
+// looks something like:
+//  { "entries": [
+//    {"url": "s3://clever-analytics/mongo_students_1_2016-01-27T21:00:00Z.json.gz", "mandatory": true, "meta": {"content_length": 1024, "sha256": "9f86d0..."}},
+//    {"url": "s3://clever-analytics/mongo_students_2_2016-01-27T21:00:00Z.json.gz", "mandatory": true, "meta": {"content_length": 2048, "sha256": "60303a..."}}
+//  ] }
+func createManifest(store Storage, dataFiles []dataFile) (io.Reader, error) {
+	jsonVal, err := json.Marshal(Manifest{Entries: manifestEntries(store, dataFiles)})
+	if err != nil {
+		return nil, err
+	}
+	log.InfoD("manifest-file-contents", logger.M{"value": string(jsonVal)})
+	return bytes.NewReader(jsonVal), nil
+}
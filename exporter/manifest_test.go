@@ -0,0 +1,31 @@
+package exporter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateManifest(t *testing.T) {
+	reader, err := createManifest(newS3Storage("bucket", "", s3Options{}, checksumAlgorithms["sha256"]), []dataFile{
+		{Name: "foo", ContentLength: 10},
+		{Name: "bar", ContentLength: 20, Digest: digest{algorithm: "sha256", value: "fcde2b2e"}},
+	})
+	assert.NoError(t, err)
+	expectedManifest := &Manifest{
+		EntryArray{
+			map[string]interface{}{"url": "s3://bucket/foo", "mandatory": true, "meta": map[string]interface{}{"content_length": 10.0}},
+			map[string]interface{}{"url": "s3://bucket/bar", "mandatory": true, "meta": map[string]interface{}{"content_length": 20.0, "sha256": "fcde2b2e"}},
+		},
+	}
+
+	bytes, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	manifest := &Manifest{}
+	err = json.Unmarshal(bytes, manifest)
+	assert.NoError(t, err)
+	// check that the manifest entries match
+	assert.Equal(t, expectedManifest.Entries, manifest.Entries)
+}
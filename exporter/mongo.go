@@ -0,0 +1,202 @@
+package exporter
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// Connect connects to the database named in the url. All of the url's options
+// (tls, readPreference, authSource, authMechanism, mongodb+srv:// etc.) are respected.
+// When the url doesn't say otherwise we use TLS and read from the nearest member.
+// username and password, if set, override any credentials in the url.
+func Connect(ctx context.Context, url, username, password string) (*mongo.Database, error) {
+	log.InfoD("mongo-connection-call", logger.M{"url": url})
+	cs, err := connstring.Parse(url)
+	if err != nil {
+		log.ErrorD("mongo-parse-url-error", logger.M{"error": err.Error()})
+		return nil, err
+	}
+	if cs.Database == "" {
+		return nil, errors.New("mongo url must include a database")
+	}
+
+	opts := options.Client().ApplyURI(url)
+	if !cs.SSLSet {
+		opts.SetTLSConfig(&tls.Config{})
+	}
+	if cs.ReadPreference == "" {
+		opts.SetReadPreference(readpref.Nearest())
+	}
+	if username != "" {
+		log.Info("mongo-username-set")
+		// like mgo, authenticate against the url's database unless told otherwise
+		authSource := cs.AuthSource
+		if authSource == "" {
+			authSource = cs.Database
+		}
+		opts.SetAuth(options.Credential{
+			AuthMechanism:           cs.AuthMechanism,
+			AuthMechanismProperties: cs.AuthMechanismProperties,
+			AuthSource:              authSource,
+			Username:                username,
+			Password:                password,
+		})
+	}
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		log.ErrorD("mongo-dial-error", logger.M{"error": err.Error()})
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		log.ErrorD("mongo-dial-error", logger.M{"error": err.Error()})
+		return nil, err
+	}
+	log.Info("mongo-dial-successful")
+	return client.Database(cs.Database), nil
+}
+
+// normalizeDocument converts a document decoded by the mongo driver into the plain maps,
+// slices and times that the Flattener and coercion work with
+func normalizeDocument(doc bson.M) optimus.Row {
+	row := optimus.Row{}
+	for k, v := range doc {
+		row[k] = normalizeValue(v)
+	}
+	return row
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case primitive.M:
+		return map[string]interface{}(normalizeDocument(val))
+	case primitive.D:
+		return map[string]interface{}(normalizeDocument(val.Map()))
+	case primitive.A:
+		arr := make([]interface{}, len(val))
+		for i, elem := range val {
+			arr[i] = normalizeValue(elem)
+		}
+		return arr
+	case primitive.DateTime:
+		return time.Unix(0, int64(val)*int64(time.Millisecond)).UTC()
+	case primitive.Decimal128:
+		return val.String()
+	}
+	return v
+}
+
+// cursorTable is an optimus.Table of the documents read from a mongo cursor
+type cursorTable struct {
+	rows     chan optimus.Row
+	err      error
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newCursorTable(ctx context.Context, cursor *mongo.Cursor) optimus.Table {
+	t := &cursorTable{rows: make(chan optimus.Row), stopped: make(chan struct{})}
+	go func() {
+		defer close(t.rows)
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			doc := bson.M{}
+			if err := cursor.Decode(&doc); err != nil {
+				t.err = err
+				return
+			}
+			select {
+			case t.rows <- normalizeDocument(doc):
+			case <-t.stopped:
+				return
+			}
+		}
+		t.err = cursor.Err()
+	}()
+	return t
+}
+
+func (t *cursorTable) Rows() <-chan optimus.Row { return t.rows }
+func (t *cursorTable) Err() error               { return t.err }
+func (t *cursorTable) Stop()                    { t.stopOnce.Do(func() { close(t.stopped) }) }
+
+// configuredOptimusTable reads the table's documents matching query, at most limit of them
+// unless limit is 0. Cancelling ctx stops the cursor.
+func configuredOptimusTable(ctx context.Context, db *mongo.Database, table config.Table, query bson.M, limit int64) (optimus.Table, error) {
+	fields := bson.M{}
+	if table.Meta.UseProjectionOptimization == true {
+		// Create a projection to only pull the fields we're interested in
+		for _, f := range table.Fields {
+			if f.Source != "" {
+				fields[f.Source] = 1
+			}
+		}
+		if table.Meta.IncrementalField != "" {
+			fields[table.Meta.IncrementalField] = 1
+		}
+	}
+
+	opts := options.Find().SetBatchSize(1000)
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	if len(fields) > 0 {
+		opts.SetProjection(fields)
+	}
+	if table.Meta.Distribution() == config.DistributeRoundRobin {
+		// round robin files only come out the same on reruns if rows are read in the same order
+		opts.SetSort(bson.M{"_id": 1})
+	}
+	if query == nil {
+		query = bson.M{}
+	}
+	cursor, err := db.Collection(table.Source).Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newCursorTable(ctx, cursor), nil
+}
+
+// countDocuments counts the documents of the table's collection that query selects
+func countDocuments(ctx context.Context, db *mongo.Database, table config.Table, query bson.M) (int64, error) {
+	if query == nil {
+		query = bson.M{}
+	}
+	return db.Collection(table.Source).CountDocuments(ctx, query)
+}
+
+// reconcileCount checks the rows read against the documents mongo counted before reading
+// them. Documents written while the collection is read can be missed or read, so rows
+// that differ from the count are only an error if they're outside of it and the count
+// taken afterwards by countAfter.
+func reconcileCount(table string, read, before int64, countAfter func() (int64, error)) error {
+	if read == before {
+		return nil
+	}
+	after, err := countAfter()
+	if err != nil {
+		return &ReadError{Table: table, Err: err}
+	}
+	low, high := before, after
+	if low > high {
+		low, high = high, low
+	}
+	if read < low || read > high {
+		return &CountError{Table: table, Read: read, Before: before, After: after}
+	}
+	log.WarnD("row-count-changed", logger.M{"collection": table, "read": read, "before": before, "after": after})
+	return nil
+}
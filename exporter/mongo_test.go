@@ -0,0 +1,28 @@
+package exporter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileCount(t *testing.T) {
+	counts := func(after int64) func() (int64, error) {
+		return func() (int64, error) { return after, nil }
+	}
+	assert.NoError(t, reconcileCount("students", 10, 10, nil))
+	// documents inserted or deleted while reading
+	assert.NoError(t, reconcileCount("students", 11, 10, counts(12)))
+	assert.NoError(t, reconcileCount("students", 9, 10, counts(8)))
+
+	var countErr *CountError
+	assert.True(t, errors.As(reconcileCount("students", 9, 10, counts(10)), &countErr))
+	assert.Equal(t, &CountError{Table: "students", Read: 9, Before: 10, After: 10}, countErr)
+	assert.True(t, errors.As(reconcileCount("students", 13, 10, counts(12)), &countErr))
+
+	var readErr *ReadError
+	assert.True(t, errors.As(reconcileCount("students", 9, 10, func() (int64, error) {
+		return 0, errors.New("connection reset")
+	}), &readErr))
+}
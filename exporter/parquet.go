@@ -0,0 +1,90 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// defaultRowGroupMB is the row group size Spectrum and Athena recommend
+const defaultRowGroupMB = 128
+
+var parquetCompression = map[string]parquet.CompressionCodec{
+	"":       parquet.CompressionCodec_SNAPPY,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"zstd":   parquet.CompressionCodec_ZSTD,
+}
+
+// parquetSchema returns the table's columns in the order they are declared, in
+// parquet-go's tag syntax
+func parquetSchema(t config.Table) []string {
+	schema := []string{}
+	for _, field := range t.Columns() {
+		var physicalType string
+		switch field.BaseType() {
+		case "boolean":
+			physicalType = "type=BOOLEAN"
+		case "int":
+			physicalType = "type=INT32"
+		case "bigint":
+			physicalType = "type=INT64"
+		case "float":
+			physicalType = "type=DOUBLE"
+		case "timestamp":
+			physicalType = "type=INT64, convertedtype=TIMESTAMP_MICROS"
+		case "date":
+			physicalType = "type=INT32, convertedtype=DATE"
+		default:
+			physicalType = "type=BYTE_ARRAY, convertedtype=UTF8"
+		}
+		repetition := "OPTIONAL"
+		if columnRequired(t, field) {
+			repetition = "REQUIRED"
+		}
+		schema = append(schema, fmt.Sprintf("name=%s, %s, repetitiontype=%s", field.Destination, physicalType, repetition))
+	}
+	return schema
+}
+
+// parquetSink writes the rows to a parquet file with the schema of the table's columns
+func parquetSink(t config.Table, w io.Writer) optimus.Sink {
+	columns := t.Columns()
+	return func(source optimus.Table) error {
+		defer source.Stop()
+		// files are already written in parallel, so each one is marshalled by one goroutine
+		pw, err := writer.NewCSVWriterFromWriter(parquetSchema(t), w, 1)
+		if err != nil {
+			return err
+		}
+		pw.CompressionType = parquetCompression[t.Meta.Compression]
+		rowGroupMB := t.Meta.RowGroupMB
+		if rowGroupMB == 0 {
+			rowGroupMB = defaultRowGroupMB
+		}
+		pw.RowGroupSize = int64(rowGroupMB) * 1024 * 1024
+
+		baseTypes := make([]string, len(columns))
+		for i, field := range columns {
+			baseTypes[i] = field.BaseType()
+		}
+		for row := range source.Rows() {
+			record := make([]interface{}, len(columns))
+			for i, field := range columns {
+				if record[i], err = binaryValue(baseTypes[i], row[field.Destination]); err != nil {
+					return fmt.Errorf("column %s: %s", field.Destination, err)
+				}
+			}
+			if err := pw.Write(record); err != nil {
+				return err
+			}
+		}
+		if err := source.Err(); err != nil {
+			return err
+		}
+		return pw.WriteStop()
+	}
+}
@@ -0,0 +1,33 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParquetSchema(t *testing.T) {
+	table := config.Table{
+		Fields: []config.Field{
+			{Destination: "id", Type: "text", PrimaryKey: true, NotNull: true},
+			{Destination: "grade", Type: "int"},
+			{Destination: "created", Type: "timestamp", NotNull: true},
+			{Destination: "birthday", Type: "date"},
+			{Destination: "has_email", Type: "boolean"},
+		},
+	}
+	assert.Equal(t, []string{
+		"name=id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED",
+		"name=grade, type=INT32, repetitiontype=OPTIONAL",
+		"name=created, type=INT64, convertedtype=TIMESTAMP_MICROS, repetitiontype=REQUIRED",
+		"name=birthday, type=INT32, convertedtype=DATE, repetitiontype=OPTIONAL",
+		"name=has_email, type=BOOLEAN, repetitiontype=OPTIONAL",
+	}, parquetSchema(table))
+
+	// change stream deletes leave non-key columns empty
+	table.Meta.OperationColumn = "operation"
+	schema := parquetSchema(table)
+	assert.Equal(t, "name=id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED", schema[0])
+	assert.Equal(t, "name=created, type=INT64, convertedtype=TIMESTAMP_MICROS, repetitiontype=OPTIONAL", schema[2])
+}
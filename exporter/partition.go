@@ -0,0 +1,136 @@
+package exporter
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// idRange is the half-open range of _ids [Min, Max) read by one cursor.
+// A nil bound is unbounded, so the first and last ranges also pick up any outliers.
+type idRange struct {
+	Min interface{}
+	Max interface{}
+}
+
+// query returns the filter selecting the documents in the range that also match filter
+func (r idRange) query(filter bson.M) bson.M {
+	bounds := bson.M{}
+	if r.Min != nil {
+		bounds["$gte"] = r.Min
+	}
+	if r.Max != nil {
+		bounds["$lt"] = r.Max
+	}
+	if len(bounds) == 0 {
+		return filter
+	}
+	rangeQuery := bson.M{"_id": bounds}
+	if len(filter) == 0 {
+		return rangeQuery
+	}
+	return bson.M{"$and": []bson.M{filter, rangeQuery}}
+}
+
+// rangesFromBoundaries turns sorted split points into the ranges between them
+func rangesFromBoundaries(boundaries []interface{}) []idRange {
+	ranges := []idRange{}
+	var min interface{}
+	for _, boundary := range boundaries {
+		ranges = append(ranges, idRange{Min: min, Max: boundary})
+		min = boundary
+	}
+	return append(ranges, idRange{Min: min})
+}
+
+// minObjectIDAt returns the smallest ObjectId created at t. Unlike
+// primitive.NewObjectIDFromTimestamp it doesn't fill in the machine and counter bytes,
+// so it makes a repeatable boundary.
+func minObjectIDAt(t time.Time) primitive.ObjectID {
+	var id primitive.ObjectID
+	binary.BigEndian.PutUint32(id[0:4], uint32(t.Unix()))
+	return id
+}
+
+// objectIDBoundaries splits the time between two ObjectIds into n equal parts
+func objectIDBoundaries(first, last primitive.ObjectID, n int) []interface{} {
+	start := first.Timestamp()
+	span := last.Timestamp().Sub(start)
+	boundaries := []interface{}{}
+	var previous time.Time
+	for i := 1; i < n; i++ {
+		t := start.Add(span * time.Duration(i) / time.Duration(n))
+		// ObjectIds only have second precision, so small spans can't be split n ways
+		if t.Unix() <= start.Unix() || t.Unix() == previous.Unix() {
+			continue
+		}
+		previous = t
+		boundaries = append(boundaries, minObjectIDAt(t))
+	}
+	return boundaries
+}
+
+// splitIDRanges splits the documents matching filter into at most n _id ranges so that each
+// can be read by its own cursor. ObjectIds are split by their creation time, which only
+// needs the first and last _id; other _id types are split into even buckets by $bucketAuto.
+func splitIDRanges(ctx context.Context, c *mongo.Collection, filter bson.M, n int) ([]idRange, error) {
+	if n <= 1 {
+		return []idRange{{}}, nil
+	}
+	if filter == nil {
+		filter = bson.M{}
+	}
+
+	var first, last struct {
+		ID interface{} `bson:"_id"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+	err := c.FindOne(ctx, filter, opts.SetSort(bson.M{"_id": 1})).Decode(&first)
+	if err == mongo.ErrNoDocuments {
+		return []idRange{{}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := c.FindOne(ctx, filter, opts.SetSort(bson.M{"_id": -1})).Decode(&last); err != nil {
+		return nil, err
+	}
+
+	firstOID, firstOK := first.ID.(primitive.ObjectID)
+	lastOID, lastOK := last.ID.(primitive.ObjectID)
+	if firstOK && lastOK {
+		boundaries := objectIDBoundaries(firstOID, lastOID, n)
+		log.InfoD("id-ranges-split", logger.M{"method": "objectid", "ranges": len(boundaries) + 1})
+		return rangesFromBoundaries(boundaries), nil
+	}
+
+	var buckets []struct {
+		ID struct {
+			Min interface{} `bson:"min"`
+		} `bson:"_id"`
+	}
+	cursor, err := c.Aggregate(ctx, []bson.M{
+		{"$match": filter},
+		{"$bucketAuto": bson.M{"groupBy": "$_id", "buckets": n}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &buckets); err != nil {
+		return nil, err
+	}
+	boundaries := []interface{}{}
+	for i, bucket := range buckets {
+		// the first bucket's minimum is covered by the unbounded first range
+		if i > 0 {
+			boundaries = append(boundaries, bucket.ID.Min)
+		}
+	}
+	log.InfoD("id-ranges-split", logger.M{"method": "bucketauto", "ranges": len(boundaries) + 1})
+	return rangesFromBoundaries(boundaries), nil
+}
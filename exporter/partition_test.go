@@ -0,0 +1,47 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIDRangeQuery(t *testing.T) {
+	assert.Nil(t, idRange{}.query(nil))
+	assert.Equal(t, bson.M{"a": 1}, idRange{}.query(bson.M{"a": 1}))
+	assert.Equal(t, bson.M{"_id": bson.M{"$gte": 1, "$lt": 5}}, idRange{Min: 1, Max: 5}.query(nil))
+	assert.Equal(t, bson.M{"$and": []bson.M{
+		{"a": 1},
+		{"_id": bson.M{"$gte": 1}},
+	}}, idRange{Min: 1}.query(bson.M{"a": 1}))
+}
+
+func TestRangesFromBoundaries(t *testing.T) {
+	assert.Equal(t, []idRange{{}}, rangesFromBoundaries(nil))
+	assert.Equal(t, []idRange{
+		{Max: 10},
+		{Min: 10, Max: 20},
+		{Min: 20},
+	}, rangesFromBoundaries([]interface{}{10, 20}))
+}
+
+func TestObjectIDBoundaries(t *testing.T) {
+	start := time.Unix(1000, 0)
+	first := primitive.NewObjectIDFromTimestamp(start)
+	last := primitive.NewObjectIDFromTimestamp(start.Add(400 * time.Second))
+
+	boundaries := objectIDBoundaries(first, last, 4)
+	assert.Equal(t, []interface{}{
+		minObjectIDAt(start.Add(100 * time.Second)),
+		minObjectIDAt(start.Add(200 * time.Second)),
+		minObjectIDAt(start.Add(300 * time.Second)),
+	}, boundaries)
+	assert.Equal(t, "0000044c0000000000000000", boundaries[0].(primitive.ObjectID).Hex())
+
+	// a two second span can only be split once
+	last = primitive.NewObjectIDFromTimestamp(start.Add(2 * time.Second))
+	assert.Len(t, objectIDBoundaries(first, last, 4), 1)
+}
@@ -0,0 +1,139 @@
+package exporter
+
+import (
+	"net/url"
+	"sort"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// partitionNull is the value of the partition of rows without one, named the way Hive
+// names it
+const partitionNull = "__HIVE_DEFAULT_PARTITION__"
+
+// partitioner returns the partition a row belongs in, e.g. district_id=123
+type partitioner func(row optimus.Row) string
+
+// tablePartitioner returns the partitioner of tables that are partitioned, or nil
+func tablePartitioner(t config.Table) partitioner {
+	field, ok := t.PartitionField()
+	if !ok {
+		return nil
+	}
+	// timestamps and dates are already formatted, so their day is the first 10 characters
+	byDay := field.BaseType() == "timestamp" || field.BaseType() == "date"
+	return func(row optimus.Row) string {
+		val := row[field.Destination]
+		if val == nil {
+			return field.Destination + "=" + partitionNull
+		}
+		value := delimitedString(val)
+		if byDay && len(value) > 10 {
+			value = value[:10]
+		}
+		// values can't add levels to the key or break its URL
+		return field.Destination + "=" + url.PathEscape(value)
+	}
+}
+
+// maxOpenPartitions is how many partition files a table writes at once, across all of its
+// ranges. Each open file is encoded and uploaded a part at a time, holding up to
+// uploadConcurrency parts in flight and one being read, so a table's upload buffers take up
+// to 32 * 6 * 5MB, roughly 1GB, on top of its encoders' buffers, and a run's that many times
+// its concurrency. Once a range has its share of partitions open, the least recently
+// written one is finished to make room for another, and its later rows go to new files.
+const maxOpenPartitions = 32
+
+// openPartitionsPerRange returns how many partitions each range of a table with numFiles
+// files can have open, so that its ranges together stay within maxOpenPartitions. Tables
+// that distribute rows have one range, but numFiles files for each partition. Tables with
+// more than maxOpenPartitions files keep one partition of each range open.
+func openPartitionsPerRange(numFiles int) int {
+	if perRange := maxOpenPartitions / numFiles; perRange > 0 {
+		return perRange
+	}
+	return 1
+}
+
+// openPartition is a partition whose sink is being sent rows
+type openPartition struct {
+	rows *chanTable
+	done chan error
+	// lastRow is the number of the partition's latest row, which orders the partitions by
+	// how recently they were written
+	lastRow int
+}
+
+// finish ends the partition's rows and waits for its sink
+func (p *openPartition) finish() error {
+	p.rows.end()
+	return <-p.done
+}
+
+// partitioningSink sends each row on to the sink of its partition, starting the sink the
+// first time a row of the partition is seen. At most maxOpen sinks are running, and a
+// partition that was finished to make room for others gets a new sink if it's seen again.
+func partitioningSink(partition partitioner, maxOpen int, newSink func(partition string) optimus.Sink) optimus.Sink {
+	return func(source optimus.Table) error {
+		defer source.Stop()
+		parts := map[string]*openPartition{}
+		var err error
+		finish := func(p string) {
+			if partErr := parts[p].finish(); partErr != nil && err == nil {
+				err = partErr
+			}
+			delete(parts, p)
+		}
+		rowNumber := 0
+		for row := range source.Rows() {
+			rowNumber++
+			p := partition(row)
+			part, ok := parts[p]
+			if !ok {
+				if len(parts) >= maxOpen {
+					finish(leastRecentPartition(parts))
+					if err != nil {
+						break
+					}
+				}
+				part = &openPartition{rows: newChanTable(), done: make(chan error, 1)}
+				parts[p] = part
+				go func(part *openPartition, sink optimus.Sink) {
+					part.done <- sink(part.rows)
+				}(part, newSink(p))
+			}
+			part.lastRow = rowNumber
+			part.rows.send(row)
+		}
+		for p := range parts {
+			finish(p)
+		}
+		if err != nil {
+			return err
+		}
+		return source.Err()
+	}
+}
+
+// leastRecentPartition returns the open partition whose latest row came first
+func leastRecentPartition(parts map[string]*openPartition) string {
+	least := ""
+	for p, part := range parts {
+		if least == "" || part.lastRow < parts[least].lastRow {
+			least = p
+		}
+	}
+	return least
+}
+
+// sortedPartitions returns the partitions in order, so that manifests list them the same
+// way on every run
+func sortedPartitions(files map[string][]dataFile) []string {
+	partitions := []string{}
+	for partition := range files {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+	return partitions
+}
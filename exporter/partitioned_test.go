@@ -0,0 +1,125 @@
+package exporter
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/Clever/optimus.v3"
+	"gopkg.in/Clever/optimus.v3/sources/slice"
+)
+
+func TestOpenPartitionsPerRange(t *testing.T) {
+	assert.Equal(t, 32, openPartitionsPerRange(1))
+	assert.Equal(t, 8, openPartitionsPerRange(4))
+	assert.Equal(t, 3, openPartitionsPerRange(10))
+	assert.Equal(t, 1, openPartitionsPerRange(64))
+}
+
+func TestTablePartitioner(t *testing.T) {
+	table := config.Table{
+		Fields: []config.Field{
+			{Destination: "district_id", Source: "district", Type: "text"},
+			{Destination: "created", Source: "created", Type: "timestamp"},
+			{Destination: "grade", Source: "grade", Type: "int"},
+		},
+	}
+	assert.Nil(t, tablePartitioner(table))
+
+	table.Meta.PartitionColumn = "district_id"
+	partition := tablePartitioner(table)
+	assert.Equal(t, "district_id=abc", partition(optimus.Row{"district_id": "abc"}))
+	assert.Equal(t, "district_id=a%2Fb%20c", partition(optimus.Row{"district_id": "a/b c"}))
+	assert.Equal(t, "district_id=__HIVE_DEFAULT_PARTITION__", partition(optimus.Row{"district_id": nil}))
+
+	table.Meta.PartitionColumn = "created"
+	partition = tablePartitioner(table)
+	assert.Equal(t, "created=2016-01-27", partition(optimus.Row{"created": "2016-01-27T21:04:05.123Z"}))
+
+	table.Meta.PartitionColumn = "grade"
+	partition = tablePartitioner(table)
+	assert.Equal(t, "grade=10", partition(optimus.Row{"grade": int64(10)}))
+}
+
+func TestPartitioningSink(t *testing.T) {
+	rows := []optimus.Row{
+		{"id": "1", "district_id": "a"},
+		{"id": "2", "district_id": "b"},
+		{"id": "3", "district_id": "a"},
+	}
+	partition := func(row optimus.Row) string { return "district_id=" + row["district_id"].(string) }
+	var mu sync.Mutex
+	received := map[string][]string{}
+	sinks := 0
+	newSink := func(p string) optimus.Sink {
+		sinks++
+		return func(source optimus.Table) error {
+			for row := range source.Rows() {
+				mu.Lock()
+				received[p] = append(received[p], row["id"].(string))
+				mu.Unlock()
+			}
+			return nil
+		}
+	}
+	assert.NoError(t, partitioningSink(partition, 2, newSink)(slice.New(rows)))
+	assert.Equal(t, map[string][]string{"district_id=a": {"1", "3"}, "district_id=b": {"2"}}, received)
+	assert.Equal(t, 2, sinks)
+
+	// partitions are finished to make room for others, and reopened if they're seen again
+	received, sinks = map[string][]string{}, 0
+	assert.NoError(t, partitioningSink(partition, 1, newSink)(slice.New(rows)))
+	assert.Equal(t, map[string][]string{"district_id=a": {"1", "3"}, "district_id=b": {"2"}}, received)
+	assert.Equal(t, 3, sinks)
+}
+
+func TestPartitioningSinkLeastRecent(t *testing.T) {
+	rows := []optimus.Row{
+		{"id": "1", "district_id": "a"},
+		{"id": "2", "district_id": "b"},
+		{"id": "3", "district_id": "a"},
+		{"id": "4", "district_id": "c"},
+		{"id": "5", "district_id": "a"},
+		{"id": "6", "district_id": "b"},
+	}
+	partition := func(row optimus.Row) string { return row["district_id"].(string) }
+	var mu sync.Mutex
+	opened := []string{}
+	sink := partitioningSink(partition, 2, func(p string) optimus.Sink {
+		mu.Lock()
+		opened = append(opened, p)
+		mu.Unlock()
+		return func(source optimus.Table) error {
+			for range source.Rows() {
+			}
+			return nil
+		}
+	})
+	assert.NoError(t, sink(slice.New(rows)))
+	// c makes room by finishing b, which was written less recently than a
+	assert.Equal(t, []string{"a", "b", "c", "b"}, opened)
+}
+
+func TestPartitioningSinkError(t *testing.T) {
+	rows := []optimus.Row{{"district_id": "a"}, {"district_id": "b"}, {"district_id": "c"}}
+	partition := func(row optimus.Row) string { return row["district_id"].(string) }
+	sink := partitioningSink(partition, 1, func(p string) optimus.Sink {
+		return func(source optimus.Table) error {
+			defer source.Stop()
+			if p == "a" {
+				return errors.New("upload failed")
+			}
+			for range source.Rows() {
+			}
+			return nil
+		}
+	})
+	assert.EqualError(t, sink(slice.New(rows)), "upload failed")
+}
+
+func TestSortedPartitions(t *testing.T) {
+	files := map[string][]dataFile{"district_id=b": nil, "district_id=a": nil, "district_id=c": nil}
+	assert.Equal(t, []string{"district_id=a", "district_id=b", "district_id=c"}, sortedPartitions(files))
+}
@@ -0,0 +1,57 @@
+package exporter
+
+import (
+	"context"
+	"io"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// Preview writes up to n of the table's rows to w as JSON, one object per line, the way
+// they would be exported. Nothing is written to the storage. It returns how many rows
+// were written.
+func (e *Exporter) Preview(ctx context.Context, n int64, w io.Writer) (int, error) {
+	if e.db == nil {
+		return 0, &ConfigError{Table: e.table.Destination, Err: errNoDatabase}
+	}
+	table := *e.table
+	source, err := configuredOptimusTable(ctx, e.db, table, nil, n)
+	if err != nil {
+		return 0, &ReadError{Table: table.Destination, Err: err}
+	}
+	stats := config.NewCoercionStats()
+	rows, err := exportData(source, table, jsonSink(table, w), e.run.timestamp, stats)
+	if err != nil {
+		return rows, &ReadError{Table: table.Destination, Err: err}
+	}
+	for column, count := range stats.Failures() {
+		log.WarnD("coercion-failures", logger.M{"collection": table.Destination, "column": column, "count": count})
+	}
+	return rows, nil
+}
+
+// Sample returns up to n documents of the collection picked at random, e.g. to infer a
+// table from with config.InferTable
+func Sample(ctx context.Context, db *mongo.Database, collection string, n int64) ([]optimus.Row, error) {
+	cursor, err := db.Collection(collection).Aggregate(ctx, []bson.M{{"$sample": bson.M{"size": n}}})
+	if err != nil {
+		return nil, &ReadError{Table: collection, Err: err}
+	}
+	defer cursor.Close(ctx)
+	docs := []optimus.Row{}
+	for cursor.Next(ctx) {
+		doc := bson.M{}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, &ReadError{Table: collection, Err: err}
+		}
+		docs = append(docs, normalizeDocument(doc))
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, &ReadError{Table: collection, Err: err}
+	}
+	return docs, nil
+}
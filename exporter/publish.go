@@ -0,0 +1,91 @@
+package exporter
+
+import (
+	"bytes"
+	"path"
+	"sync"
+
+	json "github.com/pquerna/ffjson/ffjson"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// stagingPrefix is where staged runs write data files before publishing them, under the
+// run's ID
+const stagingPrefix = "_staging"
+
+// publishConcurrency is how many files are moved into place at once
+const publishConcurrency = 8
+
+// stagingKey returns the key a data file is written to before it is published to key
+func (r exportRun) stagingKey(key string) string {
+	if !r.staged {
+		return key
+	}
+	return path.Join(stagingPrefix, r.runID, key)
+}
+
+// publishFiles moves the run's staged data files to their keys
+func publishFiles(run exportRun, store Storage, files []dataFile) error {
+	if !run.staged {
+		return nil
+	}
+	sem := make(chan struct{}, publishConcurrency)
+	errs := make(chan error, len(files))
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(len(files))
+	for _, f := range files {
+		go func(f dataFile) {
+			defer waitGroup.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := store.move(run.stagingKey(f.Name), f.Name, f.Digest); err != nil {
+				errs <- &StorageError{URL: store.url(f.Name), Err: err}
+			}
+		}(f)
+	}
+	waitGroup.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	log.InfoD("files-published", logger.M{"files": len(files)})
+	return nil
+}
+
+// commitMarker is the _SUCCESS_<run id> file written once all of a table's files are in
+// place. It lists them, so that consumers can check they have everything the run wrote.
+type commitMarker struct {
+	RunID     string     `json:"run_id"`
+	Timestamp string     `json:"timestamp"`
+	Table     string     `json:"table"`
+	Rows      int64      `json:"rows"`
+	Manifests []string   `json:"manifests"`
+	Files     EntryArray `json:"files"`
+}
+
+// commitMarkerKey returns the key of a run's _SUCCESS file, next to the table's manifest.
+// It's named after the run, since runs with the same data date share the manifest's prefix.
+func commitMarkerKey(run exportRun, keys keyNamer) string {
+	return path.Join(path.Dir(keys.key("", ".manifest")), "_SUCCESS_"+run.runID)
+}
+
+// writeCommitMarker writes the _SUCCESS file of a table's export to key
+func writeCommitMarker(run exportRun, store Storage, key string, table string, rows int64, manifests []string, files []dataFile) error {
+	manifestURLs := []string{}
+	for _, manifest := range manifests {
+		manifestURLs = append(manifestURLs, store.url(manifest))
+	}
+	data, err := json.Marshal(commitMarker{
+		RunID:     run.runID,
+		Timestamp: run.timestamp,
+		Table:     table,
+		Rows:      rows,
+		Manifests: manifestURLs,
+		Files:     manifestEntries(store, files),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = uploadFile(bytes.NewReader(data), store, key)
+	return err
+}
@@ -0,0 +1,81 @@
+package exporter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStagingKey(t *testing.T) {
+	run := exportRun{runID: "20160127T213012Z"}
+	assert.Equal(t, "mongo_raw/students/a.json.gz", run.stagingKey("mongo_raw/students/a.json.gz"))
+	run.staged = true
+	assert.Equal(t, "_staging/20160127T213012Z/mongo_raw/students/a.json.gz", run.stagingKey("mongo_raw/students/a.json.gz"))
+}
+
+func TestPublishFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongo-to-s3")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := localStorage{dir: dir, checksum: checksumAlgorithms["sha256"]}
+	run := exportRun{runID: "20160127T213012Z", staged: true}
+
+	files := []dataFile{}
+	for _, name := range []string{"mongo_raw/students/a_0.json.gz", "mongo_raw/students/a_1.json.gz"} {
+		d, err := uploadFile(strings.NewReader(name), store, run.stagingKey(name))
+		assert.NoError(t, err)
+		files = append(files, dataFile{Name: name, ContentLength: int64(len(name)), Digest: d})
+	}
+	// nothing is at the final keys until the files are published
+	_, err = store.read(files[0].Name)
+	assert.Equal(t, errFileNotFound, err)
+
+	assert.NoError(t, publishFiles(run, store, files))
+	for _, f := range files {
+		data, err := store.read(f.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, f.Name, string(data))
+		_, err = store.read(run.stagingKey(f.Name))
+		assert.Equal(t, errFileNotFound, err)
+	}
+
+	// missing staged files fail the publish
+	assert.Error(t, publishFiles(run, store, []dataFile{{Name: "mongo_raw/students/b.json.gz"}}))
+}
+
+func TestWriteCommitMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongo-to-s3")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := localStorage{dir: dir, checksum: checksumAlgorithms["sha256"]}
+	run := exportRun{runID: "20160127T213012Z", timestamp: "2016-01-27T21:00:00Z", keyLayout: "redshift"}
+	keys, err := newKeyNamer("redshift", newKeyVars("mongo_raw", "students", "", run.timestamp, run.runID))
+	assert.NoError(t, err)
+
+	files := []dataFile{{Name: keys.key("0", ".json.gz"), ContentLength: 10, Digest: digest{algorithm: "sha256", value: "fcde2b2e"}}}
+	manifest := keys.key("", ".manifest")
+	assert.NoError(t, writeCommitMarker(run, store, commitMarkerKey(run, keys), "students", 3, []string{manifest}, files))
+
+	assert.Equal(t, "mongo_raw/students/_data_timestamp_year=2016/_data_timestamp_month=01/_data_timestamp_day=27/_SUCCESS_20160127T213012Z", commitMarkerKey(run, keys))
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(commitMarkerKey(run, keys))))
+	assert.NoError(t, err)
+	marker := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(data, &marker))
+	assert.Equal(t, map[string]interface{}{
+		"run_id":    "20160127T213012Z",
+		"timestamp": "2016-01-27T21:00:00Z",
+		"table":     "students",
+		"rows":      3.0,
+		"manifests": []interface{}{store.url(manifest)},
+		"files": []interface{}{map[string]interface{}{
+			"url":       store.url(files[0].Name),
+			"mandatory": true,
+			"meta":      map[string]interface{}{"content_length": 10.0, "sha256": "fcde2b2e"},
+		}},
+	}, marker)
+}
@@ -0,0 +1,104 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// rollLimits are the sizes at which output rolls over to a new file. Zero means no limit.
+type rollLimits struct {
+	maxBytes int64
+	maxRows  int64
+}
+
+func (l rollLimits) enabled() bool {
+	return l.maxBytes > 0 || l.maxRows > 0
+}
+
+func (l rollLimits) reached(bytes, rows int64) bool {
+	return (l.maxBytes > 0 && bytes >= l.maxBytes) || (l.maxRows > 0 && rows >= l.maxRows)
+}
+
+// fileIndex returns the index in the name of a part of one of the _id ranges. Without
+// limits each range is a single file, named after just the range, unless it's a partition
+// that was reopened.
+func (l rollLimits) fileIndex(rangeIndex, part int) string {
+	if !l.enabled() && part == 0 {
+		return strconv.Itoa(rangeIndex)
+	}
+	return fmt.Sprintf("%d_%d", rangeIndex, part)
+}
+
+// openPartFn starts uploading the output file with the given part number. The returned
+// close function is called with the file's size in bytes once it has been written, and
+// waits for the upload to finish.
+type openPartFn func(part int) (w io.Writer, close func(contentLength int64))
+
+// rollingPart is an output file that rows are being written to
+type rollingPart struct {
+	rows   *chanTable
+	output *countingWriter
+	count  int64
+	done   chan error
+	close  func(contentLength int64)
+}
+
+func startPart(t config.Table, part int, openPart openPartFn) *rollingPart {
+	w, close := openPart(part)
+	p := &rollingPart{
+		rows:   newChanTable(),
+		output: &countingWriter{w: w},
+		done:   make(chan error, 1),
+		close:  close,
+	}
+	go func() {
+		p.done <- newDataFileSink(t, p.output)(p.rows)
+	}()
+	return p
+}
+
+// finish ends the part's file and waits for it to be uploaded
+func (p *rollingPart) finish() error {
+	close(p.rows.rows)
+	err := <-p.done
+	p.close(p.output.count())
+	return err
+}
+
+// rollingSink writes the rows to a sequence of files in the table's format, starting a new
+// file once the current one reaches one of the limits. Sizes are checked as compressed
+// output is written, so files can overshoot by whatever the codec or format buffers.
+// Only the first file can be empty.
+func rollingSink(t config.Table, limits rollLimits, openPart openPartFn) optimus.Sink {
+	return func(source optimus.Table) error {
+		defer source.Stop()
+		part := 0
+		current := startPart(t, part, openPart)
+		for row := range source.Rows() {
+			if current == nil {
+				part++
+				current = startPart(t, part, openPart)
+			}
+			current.rows.send(row)
+			current.count++
+			if limits.reached(current.output.count(), current.count) {
+				if err := current.finish(); err != nil {
+					return err
+				}
+				current = nil
+			}
+		}
+		var err error
+		if current != nil {
+			err = current.finish()
+		}
+		if sourceErr := source.Err(); sourceErr != nil {
+			return sourceErr
+		}
+		return err
+	}
+}
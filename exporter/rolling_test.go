@@ -0,0 +1,68 @@
+package exporter
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/Clever/optimus.v3"
+	"gopkg.in/Clever/optimus.v3/sources/slice"
+)
+
+// bufferParts returns an openPartFn that writes each part to a buffer
+func bufferParts(parts *[]*bytes.Buffer, sizes *[]int64) openPartFn {
+	return func(part int) (io.Writer, func(int64)) {
+		buf := &bytes.Buffer{}
+		*parts = append(*parts, buf)
+		return buf, func(contentLength int64) {
+			*sizes = append(*sizes, contentLength)
+		}
+	}
+}
+
+func TestRollingSinkRows(t *testing.T) {
+	table := config.Table{Meta: config.Meta{Compression: "none"}}
+	rows := []optimus.Row{{"id": "1"}, {"id": "2"}, {"id": "3"}, {"id": "4"}, {"id": "5"}}
+	parts, sizes := []*bytes.Buffer{}, []int64{}
+	err := rollingSink(table, rollLimits{maxRows: 2}, bufferParts(&parts, &sizes))(slice.New(rows))
+	assert.NoError(t, err)
+
+	contents := []string{}
+	for i, part := range parts {
+		contents = append(contents, part.String())
+		assert.Equal(t, int64(part.Len()), sizes[i])
+	}
+	assert.Equal(t, []string{
+		"{\"id\":\"1\"}\n{\"id\":\"2\"}\n",
+		"{\"id\":\"3\"}\n{\"id\":\"4\"}\n",
+		"{\"id\":\"5\"}\n",
+	}, contents)
+}
+
+func TestRollingSinkNoTrailingEmptyFile(t *testing.T) {
+	table := config.Table{Meta: config.Meta{Compression: "none"}}
+	rows := []optimus.Row{{"id": "1"}, {"id": "2"}}
+	parts, sizes := []*bytes.Buffer{}, []int64{}
+	err := rollingSink(table, rollLimits{maxRows: 2}, bufferParts(&parts, &sizes))(slice.New(rows))
+	assert.NoError(t, err)
+	assert.Len(t, parts, 1)
+
+	// an empty source still gets a file, so that the manifest isn't empty
+	parts, sizes = []*bytes.Buffer{}, []int64{}
+	err = rollingSink(table, rollLimits{maxRows: 2}, bufferParts(&parts, &sizes))(slice.New([]optimus.Row{}))
+	assert.NoError(t, err)
+	assert.Len(t, parts, 1)
+}
+
+func TestRollLimits(t *testing.T) {
+	assert.False(t, rollLimits{}.reached(1<<40, 1<<40))
+	assert.True(t, rollLimits{maxBytes: 100}.reached(100, 1))
+	assert.False(t, rollLimits{maxBytes: 100, maxRows: 10}.reached(99, 9))
+	assert.True(t, rollLimits{maxBytes: 100, maxRows: 10}.reached(1, 10))
+
+	assert.Equal(t, "3", rollLimits{}.fileIndex(3, 0))
+	assert.Equal(t, "3_1", rollLimits{}.fileIndex(3, 1))
+	assert.Equal(t, "3_2", rollLimits{maxRows: 10}.fileIndex(3, 2))
+}
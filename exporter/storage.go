@@ -0,0 +1,505 @@
+package exporter
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+var errFileNotFound = errors.New("file not found")
+
+// Storage is where a run's files are written: data files, manifests, schemas, the config
+// copy and the state that carries over between runs. Storages are created by NewStorage.
+type Storage interface {
+	// write writes everything read from r to the file at key, and returns its digest once
+	// it has checked that the whole file was written
+	write(key string, r io.Reader) (digest, error)
+	// read returns the whole file at key, or errFileNotFound if there isn't one
+	read(key string) ([]byte, error)
+	// open returns a reader of the file at key, or errFileNotFound if there isn't one
+	open(key string) (io.ReadCloser, error)
+	// move moves the file at from to to, checking that it still has the digest it was
+	// written with
+	move(from, to string, d digest) error
+	// remove deletes the file at key if there is one
+	remove(key string) error
+	// url returns the location of the file at key, the way manifests and payloads refer to it
+	url(key string) string
+	// withEncryption returns the same storage, but writing files with the encryption
+	withEncryption(e config.Encryption) Storage
+}
+
+// StorageOptions configure a Storage
+type StorageOptions struct {
+	// Endpoint, PathStyle and Region point the S3 client at an S3 compatible store like
+	// MinIO. Setting Region skips looking up the bucket's region.
+	Endpoint  string
+	PathStyle bool
+	Region    string
+	// Checksum is the algorithm uploads are checked with and manifests record digests of:
+	// sha256 (the default) or crc32c
+	Checksum string
+	// Encryption is how objects are encrypted unless their table sets its own
+	Encryption config.Encryption
+}
+
+// NewStorage returns the storage at location, which is either s3://bucket/prefix,
+// file:///directory or the name of a bucket
+func NewStorage(location string, options StorageOptions) (Storage, error) {
+	if options.Checksum == "" {
+		options.Checksum = DefaultChecksum
+	}
+	checksum, ok := checksumAlgorithms[options.Checksum]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum '%s'", options.Checksum)
+	}
+	if err := options.Encryption.Validate(); err != nil {
+		return nil, err
+	}
+	store, err := newStorage(location, s3Options{
+		endpoint:  options.Endpoint,
+		pathStyle: options.PathStyle,
+		region:    options.Region,
+	}, checksum)
+	if err != nil {
+		return nil, err
+	}
+	return store.withEncryption(options.Encryption), nil
+}
+
+// newStorage returns the storage at location, which is either s3://bucket/prefix,
+// file:///directory or the name of a bucket. S3 storage is accessed with the options, and
+// files are checked with the checksum.
+func newStorage(location string, options s3Options, checksum checksumAlgorithm) (Storage, error) {
+	if location == "" {
+		return nil, errors.New("no storage location")
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage location '%s': %s", location, err)
+	}
+	switch u.Scheme {
+	case "":
+		return newS3Storage(location, "", options, checksum), nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("storage location '%s' has no bucket", location)
+		}
+		return newS3Storage(u.Host, strings.Trim(u.Path, "/"), options, checksum), nil
+	case "file":
+		// file://out is relative to the working directory, since url.Parse reads out as a host
+		dir, err := filepath.Abs(filepath.FromSlash(u.Host + u.Path))
+		if err != nil {
+			return nil, err
+		}
+		return localStorage{dir: dir, checksum: checksum}, nil
+	}
+	return nil, fmt.Errorf("unknown storage scheme '%s'", u.Scheme)
+}
+
+// s3Options configure the S3 client, e.g. to use an S3 compatible store like MinIO
+type s3Options struct {
+	// endpoint replaces the AWS endpoints
+	endpoint string
+	// pathStyle addresses buckets in the path instead of the host name, which most S3
+	// compatible stores need
+	pathStyle bool
+	// region skips looking up the bucket's region
+	region string
+}
+
+// defaultEndpointRegion is the region of custom endpoints that don't set one. S3 compatible
+// stores don't support looking up a bucket's region, and most ignore the region anyway.
+const defaultEndpointRegion = "us-east-1"
+
+// clientConfig returns the config of a client for the region
+func (o s3Options) clientConfig(region string) *aws.Config {
+	config := aws.NewConfig().WithRegion(region).WithS3ForcePathStyle(o.pathStyle)
+	if o.endpoint != "" {
+		config = config.WithEndpoint(o.endpoint)
+	}
+	return config
+}
+
+// s3Storage writes files to a bucket, under an optional prefix
+type s3Storage struct {
+	bucket     string
+	prefix     string
+	encryption config.Encryption
+	checksum   checksumAlgorithm
+	// serverChecksums is set when S3 checks uploads and copies against their checksums. S3
+	// compatible stores at custom endpoints often reject checksums, so their files are only
+	// checked by size, and the manifests still record the digests hashed while writing.
+	serverChecksums bool
+	// partSize is the size of the parts of multipart uploads
+	partSize int64
+	client   *lazyS3Client
+}
+
+// lazyS3Client creates the client on first use, since finding the bucket's region takes a
+// request. It is shared by the storage with each encryption.
+type lazyS3Client struct {
+	options s3Options
+	once    sync.Once
+	client  *s3.S3
+	err     error
+}
+
+func newS3Storage(bucket, prefix string, options s3Options, checksum checksumAlgorithm) *s3Storage {
+	return &s3Storage{
+		bucket:          bucket,
+		prefix:          prefix,
+		checksum:        checksum,
+		serverChecksums: options.endpoint == "",
+		partSize:        uploadPartSize,
+		client:          &lazyS3Client{options: options},
+	}
+}
+
+// s3Client returns a client for the region the bucket is in
+func (s *s3Storage) s3Client() (*s3.S3, error) {
+	c := s.client
+	c.once.Do(func() {
+		region := c.options.region
+		if region == "" && c.options.endpoint != "" {
+			region = defaultEndpointRegion
+		}
+		if region == "" {
+			if region, c.err = getRegionForBucket(s.bucket); c.err != nil {
+				return
+			}
+			log.InfoD("bucket-region-found", logger.M{"region": region})
+		}
+		c.client = s3.New(session.New(), c.options.clientConfig(region))
+	})
+	return c.client, c.err
+}
+
+func (s *s3Storage) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3Storage) write(key string, r io.Reader) (digest, error) {
+	client, err := s.s3Client()
+	if err != nil {
+		return digest{}, err
+	}
+	// the data is piped in without knowing its size up front, so it is read a part at a time
+	checksum := newObjectChecksum(s.checksum, s.partSize)
+	upload := &s3Upload{store: s, client: client, key: key, body: io.TeeReader(r, checksum)}
+	if err := upload.upload(); err != nil {
+		return digest{}, err
+	}
+	return checksum.digest(), s.verify(client, key, checksum)
+}
+
+// verify checks that the object S3 has is the one that was written, by its size and, if
+// the store checks them, its checksum
+func (s *s3Storage) verify(client *s3.S3, key string, checksum *objectChecksum) error {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	}
+	if s.serverChecksums {
+		input.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+	}
+	head, err := client.HeadObject(input)
+	if err != nil {
+		return err
+	}
+	if size := aws.Int64Value(head.ContentLength); size != checksum.size {
+		return fmt.Errorf("%s is %d bytes, but %d were written", s.url(key), size, checksum.size)
+	}
+	if !s.serverChecksums {
+		return nil
+	}
+	reported := head.ChecksumSHA256
+	if s.checksum.s3Name == s3.ChecksumAlgorithmCrc32c {
+		reported = head.ChecksumCRC32C
+	}
+	if expected := checksum.s3Checksum(); aws.StringValue(reported) != expected {
+		return fmt.Errorf("%s has %s checksum '%s', but '%s' was written", s.url(key), s.checksum.name, aws.StringValue(reported), expected)
+	}
+	return nil
+}
+
+// encryptUpload sets the upload's server side encryption headers
+func encryptUpload(input *s3.PutObjectInput, e config.Encryption) error {
+	headers, err := encryptionHeaders(e)
+	input.ServerSideEncryption = headers.serverSideEncryption
+	input.SSEKMSKeyId = headers.kmsKeyID
+	input.SSEKMSEncryptionContext = headers.kmsContext
+	input.BucketKeyEnabled = headers.bucketKey
+	return err
+}
+
+// encryptMultipartUpload sets the server side encryption headers of a multipart upload,
+// which its parts are encrypted with
+func encryptMultipartUpload(input *s3.CreateMultipartUploadInput, e config.Encryption) error {
+	headers, err := encryptionHeaders(e)
+	input.ServerSideEncryption = headers.serverSideEncryption
+	input.SSEKMSKeyId = headers.kmsKeyID
+	input.SSEKMSEncryptionContext = headers.kmsContext
+	input.BucketKeyEnabled = headers.bucketKey
+	return err
+}
+
+// encryptCopy sets the copy's server side encryption headers, since copies don't keep the
+// encryption of their source
+func encryptCopy(input *s3.CopyObjectInput, e config.Encryption) error {
+	headers, err := encryptionHeaders(e)
+	input.ServerSideEncryption = headers.serverSideEncryption
+	input.SSEKMSKeyId = headers.kmsKeyID
+	input.SSEKMSEncryptionContext = headers.kmsContext
+	input.BucketKeyEnabled = headers.bucketKey
+	return err
+}
+
+// sseHeaders are the server side encryption headers of a request. Unset headers are nil.
+type sseHeaders struct {
+	serverSideEncryption *string
+	kmsKeyID             *string
+	kmsContext           *string
+	bucketKey            *bool
+}
+
+func encryptionHeaders(e config.Encryption) (sseHeaders, error) {
+	if e.EncryptionType() == config.EncryptionAES256 {
+		return sseHeaders{serverSideEncryption: aws.String(s3.ServerSideEncryptionAes256)}, nil
+	}
+	headers := sseHeaders{serverSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms)}
+	if e.KMSKeyID != "" {
+		headers.kmsKeyID = aws.String(e.KMSKeyID)
+	}
+	if len(e.Context) > 0 {
+		// the header is base64 encoded JSON
+		context, err := json.Marshal(e.Context)
+		if err != nil {
+			return sseHeaders{}, err
+		}
+		headers.kmsContext = aws.String(base64.StdEncoding.EncodeToString(context))
+	}
+	if e.BucketKey {
+		headers.bucketKey = aws.Bool(true)
+	}
+	return headers, nil
+}
+
+// move copies the file at from to to and deletes it. Copies are single requests, so files
+// can be at most 5GB. The copy is checked against the digest the file was written with, if
+// the store checks checksums.
+func (s *s3Storage) move(from, to string, d digest) error {
+	client, err := s.s3Client()
+	if err != nil {
+		return err
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(s.key(to)),
+		CopySource: aws.String(s.bucket + "/" + (&url.URL{Path: s.key(from)}).EscapedPath()),
+	}
+	if s.serverChecksums {
+		// the copy is checksummed as a whole, rather than by the parts of the upload. Unlike
+		// uploads, copies have no body, so S3 computes the checksum itself.
+		input.ChecksumAlgorithm = aws.String(s.checksum.s3Name)
+	}
+	if err := encryptCopy(input, s.encryption); err != nil {
+		return err
+	}
+	out, err := client.CopyObject(input)
+	if err != nil {
+		return err
+	}
+	if s.serverChecksums && d.value != "" && out.CopyObjectResult != nil {
+		reported := out.CopyObjectResult.ChecksumSHA256
+		if s.checksum.s3Name == s3.ChecksumAlgorithmCrc32c {
+			reported = out.CopyObjectResult.ChecksumCRC32C
+		}
+		sum, err := hex.DecodeString(d.value)
+		if err != nil {
+			return err
+		}
+		if expected := base64.StdEncoding.EncodeToString(sum); aws.StringValue(reported) != expected {
+			return fmt.Errorf("%s was copied with %s checksum '%s', but '%s' was written", s.url(to), s.checksum.name, aws.StringValue(reported), expected)
+		}
+	}
+	return s.remove(from)
+}
+
+func (s *s3Storage) remove(key string) error {
+	client, err := s.s3Client()
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	return err
+}
+
+func (s *s3Storage) read(key string) ([]byte, error) {
+	return readFile(s, key)
+}
+
+func (s *s3Storage) open(key string) (io.ReadCloser, error) {
+	client, err := s.s3Client()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, errFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) url(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key(key))
+}
+
+func (s *s3Storage) withEncryption(e config.Encryption) Storage {
+	encrypted := *s
+	encrypted.encryption = e
+	return &encrypted
+}
+
+// localStorage writes files to a directory, e.g. to run exports without AWS
+type localStorage struct {
+	dir      string
+	checksum checksumAlgorithm
+}
+
+func (s localStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// write writes to a temporary file that is renamed into place once it is complete, so that
+// a file at key is never partially written
+func (s localStorage) write(key string, r io.Reader) (digest, error) {
+	filename := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return digest{}, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return digest{}, err
+	}
+	defer os.Remove(tmp.Name())
+	h := s.checksum.newHash()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return digest{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return digest{}, err
+	}
+	return s.checksum.digest(h), os.Rename(tmp.Name(), filename)
+}
+
+func (s localStorage) read(key string) ([]byte, error) {
+	return readFile(s, key)
+}
+
+func (s localStorage) open(key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, errFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s localStorage) url(key string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(s.path(key))}).String()
+}
+
+// move renames the file, which replaces the file at to in one step
+func (s localStorage) move(from, to string, d digest) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(to)), 0755); err != nil {
+		return err
+	}
+	return os.Rename(s.path(from), s.path(to))
+}
+
+func (s localStorage) remove(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// withEncryption returns the storage as is, since local files aren't encrypted
+func (s localStorage) withEncryption(e config.Encryption) Storage {
+	return s
+}
+
+// readFile reads the whole file at key
+func readFile(store Storage, key string) ([]byte, error) {
+	r, err := store.open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// uploadFile writes the file to the storage and returns its digest
+// it takes in a reader for maximum flexibility
+func uploadFile(reader io.Reader, store Storage, outputName string) (digest, error) {
+	location := store.url(outputName)
+	log.InfoD("uploading-file", logger.M{"filename": outputName, "path": location})
+	d, err := store.write(outputName, reader)
+	if err != nil {
+		return d, &StorageError{URL: location, Err: err}
+	}
+	return d, nil
+}
+
+// getRegionForBucket looks up the region name for the given bucket
+func getRegionForBucket(name string) (string, error) {
+	// Any region will work for the region lookup, but the request MUST use
+	// PathStyle
+	config := aws.NewConfig().WithRegion("us-west-1").WithS3ForcePathStyle(true)
+	session := session.New()
+	client := s3.New(session, config)
+	params := s3.GetBucketLocationInput{
+		Bucket: aws.String(name),
+	}
+	resp, err := client.GetBucketLocation(&params)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get location for bucket '%s', %s", name, err)
+	}
+	if resp.LocationConstraint == nil {
+		// "US Standard", returns an empty region. So return any region in the US
+		return "us-east-1", nil
+	}
+	return *resp.LocationConstraint, nil
+}
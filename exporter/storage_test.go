@@ -0,0 +1,135 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStorage(t *testing.T) {
+	store, err := newStorage("clever-analytics", s3Options{}, checksumAlgorithms["sha256"])
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://clever-analytics/mongo_raw/students/a.json.gz", store.url("mongo_raw/students/a.json.gz"))
+
+	store, err = newStorage("s3://clever-analytics/exports/", s3Options{}, checksumAlgorithms["sha256"])
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://clever-analytics/exports/mongo_raw/students/a.json.gz", store.url("mongo_raw/students/a.json.gz"))
+	assert.True(t, store.(*s3Storage).serverChecksums)
+
+	// s3 compatible stores aren't sent checksums
+	store, err = newStorage("s3://clever-analytics/exports/", s3Options{endpoint: "http://localhost:9000"}, checksumAlgorithms["sha256"])
+	assert.NoError(t, err)
+	assert.False(t, store.(*s3Storage).serverChecksums)
+
+	store, err = newStorage("file:///tmp/exports", s3Options{}, checksumAlgorithms["sha256"])
+	assert.NoError(t, err)
+	assert.Equal(t, "file:///tmp/exports/mongo_raw/students/a.json.gz", store.url("mongo_raw/students/a.json.gz"))
+
+	for _, location := range []string{"", "s3:///exports", "gs://clever-analytics"} {
+		_, err := newStorage(location, s3Options{}, checksumAlgorithms["sha256"])
+		assert.Error(t, err, location)
+	}
+}
+
+func TestS3ClientConfig(t *testing.T) {
+	config := s3Options{}.clientConfig("us-west-1")
+	assert.Equal(t, "us-west-1", *config.Region)
+	assert.Nil(t, config.Endpoint)
+	assert.False(t, *config.S3ForcePathStyle)
+
+	config = s3Options{endpoint: "http://localhost:9000", pathStyle: true}.clientConfig(defaultEndpointRegion)
+	assert.Equal(t, "us-east-1", *config.Region)
+	assert.Equal(t, "http://localhost:9000", *config.Endpoint)
+	assert.True(t, *config.S3ForcePathStyle)
+}
+
+func TestEncryptUpload(t *testing.T) {
+	input := &s3.PutObjectInput{}
+	assert.NoError(t, encryptUpload(input, config.Encryption{}))
+	assert.Equal(t, "AES256", *input.ServerSideEncryption)
+	assert.Nil(t, input.SSEKMSKeyId)
+
+	input = &s3.PutObjectInput{}
+	assert.NoError(t, encryptUpload(input, config.Encryption{
+		Type:      "kms",
+		KMSKeyID:  "alias/student-data",
+		Context:   map[string]string{"app": "mongo-to-s3"},
+		BucketKey: true,
+	}))
+	assert.Equal(t, "aws:kms", *input.ServerSideEncryption)
+	assert.Equal(t, "alias/student-data", *input.SSEKMSKeyId)
+	context, err := base64.StdEncoding.DecodeString(*input.SSEKMSEncryptionContext)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"app":"mongo-to-s3"}`, string(context))
+	assert.True(t, *input.BucketKeyEnabled)
+
+	// the default key is used when kms encryption doesn't name one
+	input = &s3.PutObjectInput{}
+	assert.NoError(t, encryptUpload(input, config.Encryption{Type: "kms"}))
+	assert.Equal(t, "aws:kms", *input.ServerSideEncryption)
+	assert.Nil(t, input.SSEKMSKeyId)
+	assert.Nil(t, input.SSEKMSEncryptionContext)
+	assert.Nil(t, input.BucketKeyEnabled)
+}
+
+func TestWithEncryption(t *testing.T) {
+	store := newS3Storage("clever-analytics", "exports", s3Options{}, checksumAlgorithms["sha256"])
+	encrypted := store.withEncryption(config.Encryption{Type: "kms"}).(*s3Storage)
+	assert.Equal(t, "kms", encrypted.encryption.Type)
+	assert.Equal(t, "", store.encryption.Type)
+	// the storages share the one client
+	assert.True(t, store.client == encrypted.client)
+	assert.Equal(t, store.url("a.json.gz"), encrypted.url("a.json.gz"))
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongo-to-s3")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := newStorage("file://"+filepath.ToSlash(dir), s3Options{}, checksumAlgorithms["sha256"])
+	assert.NoError(t, err)
+
+	_, err = store.read("mongo_raw/students/_watermark.json")
+	assert.Equal(t, errFileNotFound, err)
+
+	_, err = store.write("mongo_raw/students/_watermark.json", strings.NewReader("first"))
+	assert.NoError(t, err)
+	d, err := store.write("mongo_raw/students/_watermark.json", strings.NewReader("second"))
+	assert.NoError(t, err)
+	assert.Equal(t, digest{algorithm: "sha256", value: "16367aacb67a4a017c8da8ab95682ccb390863780f7114dda0a0e0c55644c7c4"}, d)
+	data, err := store.read("mongo_raw/students/_watermark.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+
+	// only the finished file is left behind
+	files, err := ioutil.ReadDir(filepath.Join(dir, "mongo_raw", "students"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestLocalStorageManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongo-to-s3")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := localStorage{dir: dir, checksum: checksumAlgorithms["crc32c"]}
+
+	d, err := uploadFile(strings.NewReader("data"), store, "mongo_raw/students/a.json.gz")
+	assert.NoError(t, err)
+	manifest, err := createManifest(store, []dataFile{{Name: "mongo_raw/students/a.json.gz", ContentLength: 4, Digest: d}})
+	assert.NoError(t, err)
+	_, err = uploadFile(manifest, store, "mongo_raw/students/a.manifest")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "mongo_raw", "students", "a.manifest"))
+	assert.NoError(t, err)
+	expected := `{"entries":[{"mandatory":true,"meta":{"content_length":4,"crc32c":"` + d.value + `"},"url":"file://` +
+		filepath.ToSlash(dir) + `/mongo_raw/students/a.json.gz"}]}`
+	assert.Equal(t, expected, string(bytes.TrimSpace(data)))
+}
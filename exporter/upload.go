@@ -0,0 +1,206 @@
+package exporter
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+const (
+	// uploadPartSize is the size of the parts of multipart uploads, which is S3's minimum.
+	// It is fixed so that the checksum S3 reports for an object is predictable.
+	uploadPartSize = 5 * 1024 * 1024
+	// uploadConcurrency is how many parts of an upload are sent at once
+	uploadConcurrency = 5
+)
+
+// s3Upload uploads an object in parts, the way s3manager does, but sends the checksum of
+// each part along with it, unless the store doesn't check checksums. aws-sdk-go v1 doesn't
+// compute checksums itself, and S3 rejects requests that name a checksum algorithm without
+// a checksum.
+type s3Upload struct {
+	store  *s3Storage
+	client *s3.S3
+	key    string
+	body   io.Reader
+}
+
+// readPart reads the next part of the body, which is shorter than the part size only at
+// the end of the body
+func (u *s3Upload) readPart() ([]byte, error) {
+	part := make([]byte, u.store.partSize)
+	n, err := io.ReadFull(u.body, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return part[:n], err
+}
+
+// checksum returns the base64 encoded checksum of data, the way S3 expects it
+func (u *s3Upload) checksum(data []byte) string {
+	h := u.store.checksum.newHash()
+	h.Write(data)
+	return base64Sum(h)
+}
+
+// upload uploads the body. Bodies of at most one part are sent in a single request.
+func (u *s3Upload) upload() error {
+	first, err := u.readPart()
+	if err != nil {
+		return err
+	}
+	var second []byte
+	if int64(len(first)) == u.store.partSize {
+		if second, err = u.readPart(); err != nil {
+			return err
+		}
+	}
+	if len(second) == 0 {
+		return u.putObject(first)
+	}
+	return u.multipartUpload(first, second)
+}
+
+// checksumAlgorithm returns the algorithm requests name, nil if the store doesn't check
+// checksums
+func (u *s3Upload) checksumAlgorithm() *string {
+	if !u.store.serverChecksums {
+		return nil
+	}
+	return aws.String(u.store.checksum.s3Name)
+}
+
+func (u *s3Upload) putObject(data []byte) error {
+	input := &s3.PutObjectInput{
+		Body:              bytes.NewReader(data),
+		Bucket:            aws.String(u.store.bucket),
+		Key:               aws.String(u.store.key(u.key)),
+		ChecksumAlgorithm: u.checksumAlgorithm(),
+	}
+	if u.store.serverChecksums {
+		input.ChecksumSHA256, input.ChecksumCRC32C = u.store.checksum.s3Fields(u.checksum(data))
+	}
+	if err := encryptUpload(input, u.store.encryption); err != nil {
+		return err
+	}
+	_, err := u.client.PutObject(input)
+	return err
+}
+
+// multipartUpload uploads the parts that have been read and the rest of the body. The
+// upload is aborted if any part fails, so that S3 doesn't keep the parts.
+func (u *s3Upload) multipartUpload(parts ...[]byte) error {
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(u.store.bucket),
+		Key:               aws.String(u.store.key(u.key)),
+		ChecksumAlgorithm: u.checksumAlgorithm(),
+	}
+	if err := encryptMultipartUpload(create, u.store.encryption); err != nil {
+		return err
+	}
+	out, err := u.client.CreateMultipartUpload(create)
+	if err != nil {
+		return err
+	}
+	uploadID := out.UploadId
+
+	var (
+		mu        sync.Mutex
+		completed []*s3.CompletedPart
+		firstErr  error
+		waitGroup sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	// each part in flight holds a slot, which bounds the memory parts take
+	slots := make(chan struct{}, uploadConcurrency)
+	for number := int64(1); !failed(); number++ {
+		var part []byte
+		if len(parts) > 0 {
+			part, parts = parts[0], parts[1:]
+		} else if part, err = u.readPart(); err != nil {
+			fail(err)
+			break
+		}
+		if len(part) == 0 {
+			break
+		}
+		slots <- struct{}{}
+		waitGroup.Add(1)
+		go func(number int64, part []byte) {
+			defer waitGroup.Done()
+			defer func() { <-slots }()
+			c, err := u.uploadPart(uploadID, number, part)
+			if err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			completed = append(completed, c)
+		}(number, part)
+	}
+	waitGroup.Wait()
+
+	if firstErr == nil {
+		sort.Slice(completed, func(i, j int) bool {
+			return aws.Int64Value(completed[i].PartNumber) < aws.Int64Value(completed[j].PartNumber)
+		})
+		_, firstErr = u.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(u.store.bucket),
+			Key:             aws.String(u.store.key(u.key)),
+			UploadId:        uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		})
+	}
+	if firstErr != nil {
+		if _, err := u.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(u.store.bucket),
+			Key:      aws.String(u.store.key(u.key)),
+			UploadId: uploadID,
+		}); err != nil {
+			log.ErrorD("abort-multipart-upload-error", logger.M{"path": u.store.url(u.key), "error": err.Error()})
+		}
+	}
+	return firstErr
+}
+
+func (u *s3Upload) uploadPart(uploadID *string, number int64, data []byte) (*s3.CompletedPart, error) {
+	input := &s3.UploadPartInput{
+		Body:              bytes.NewReader(data),
+		Bucket:            aws.String(u.store.bucket),
+		Key:               aws.String(u.store.key(u.key)),
+		UploadId:          uploadID,
+		PartNumber:        aws.Int64(number),
+		ChecksumAlgorithm: u.checksumAlgorithm(),
+	}
+	var sum string
+	if u.store.serverChecksums {
+		sum = u.checksum(data)
+		input.ChecksumSHA256, input.ChecksumCRC32C = u.store.checksum.s3Fields(sum)
+	}
+	out, err := u.client.UploadPart(input)
+	if err != nil {
+		return nil, err
+	}
+	part := &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(number)}
+	if u.store.serverChecksums {
+		part.ChecksumSHA256, part.ChecksumCRC32C = u.store.checksum.s3Fields(sum)
+	}
+	return part, nil
+}
@@ -0,0 +1,290 @@
+package exporter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is an S3 endpoint that checks request checksums the way S3 does
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]*fakeUpload
+	aborted int
+	// failParts makes part uploads fail
+	failParts bool
+	// rejectChecksums makes requests with checksum headers fail, like S3 compatible stores
+	// that don't support them
+	rejectChecksums bool
+}
+
+type fakeObject struct {
+	data []byte
+	// checksum is the base64 checksum S3 reports, by algorithm, e.g. SHA256
+	algorithm string
+	checksum  string
+}
+
+type fakeUpload struct {
+	key       string
+	algorithm string
+	parts     map[int64][]byte
+	checksums map[int64]string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]fakeObject{}, uploads: map[string]*fakeUpload{}}
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+// checksum returns the base64 checksum of data by an S3 algorithm name, empty without one
+func fakeChecksum(algorithm string, data []byte) string {
+	if algorithm == "" {
+		return ""
+	}
+	h := checksumAlgorithms[strings.ToLower(algorithm)].newHash()
+	h.Write(data)
+	return base64Sum(h)
+}
+
+// checkBody checks the checksum a request sends with its body, like S3 does
+func (f *fakeS3) checkBody(w http.ResponseWriter, r *http.Request, body []byte) (string, bool) {
+	algorithm := r.Header.Get("X-Amz-Sdk-Checksum-Algorithm")
+	if algorithm == "" {
+		return "", true
+	}
+	sum := r.Header.Get("X-Amz-Checksum-" + algorithm)
+	if sum == "" {
+		f.fail(w, http.StatusBadRequest, "InvalidRequest", "x-amz-sdk-checksum-algorithm specified, but no corresponding x-amz-checksum-* or x-amz-trailer headers were found.")
+		return "", false
+	}
+	if sum != fakeChecksum(algorithm, body) {
+		f.fail(w, http.StatusBadRequest, "BadDigest", "The checksum didn't match")
+		return "", false
+	}
+	return sum, true
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.URL.Path
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	if f.rejectChecksums {
+		for name := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Checksum") || strings.HasPrefix(name, "X-Amz-Sdk-Checksum") {
+				f.fail(w, http.StatusNotImplemented, "NotImplemented", name+" is not supported")
+				return
+			}
+		}
+	}
+	_, createUpload := query["uploads"]
+	switch {
+	case r.Method == http.MethodPost && createUpload:
+		id := fmt.Sprintf("upload-%d", len(f.uploads))
+		f.uploads[id] = &fakeUpload{
+			key:       key,
+			algorithm: r.Header.Get("X-Amz-Checksum-Algorithm"),
+			parts:     map[int64][]byte{},
+			checksums: map[int64]string{},
+		}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		if f.failParts {
+			f.fail(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return
+		}
+		upload := f.uploads[query.Get("uploadId")]
+		sum, ok := f.checkBody(w, r, body)
+		if !ok {
+			return
+		}
+		var number int64
+		fmt.Sscan(query.Get("partNumber"), &number)
+		upload.parts[number], upload.checksums[number] = body, sum
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, number))
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		upload := f.uploads[query.Get("uploadId")]
+		var complete struct {
+			Parts []struct {
+				PartNumber     int64
+				ChecksumSHA256 string
+				ChecksumCRC32C string
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		data, sums := []byte{}, []byte{}
+		for _, part := range complete.Parts {
+			sum := part.ChecksumSHA256 + part.ChecksumCRC32C
+			if sum != upload.checksums[part.PartNumber] {
+				f.fail(w, http.StatusBadRequest, "InvalidPart", "The part's checksum didn't match")
+				return
+			}
+			raw, _ := base64.StdEncoding.DecodeString(sum)
+			data, sums = append(data, upload.parts[part.PartNumber]...), append(sums, raw...)
+		}
+		checksum := ""
+		if upload.algorithm != "" {
+			checksum = fmt.Sprintf("%s-%d", fakeChecksum(upload.algorithm, sums), len(complete.Parts))
+		}
+		f.objects[upload.key] = fakeObject{data: data, algorithm: upload.algorithm, checksum: checksum}
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		object, ok := f.objects["/"+strings.TrimPrefix(source, "/")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		algorithm := r.Header.Get("X-Amz-Checksum-Algorithm")
+		checksum := fakeChecksum(algorithm, object.data)
+		f.objects[key] = fakeObject{data: object.data, algorithm: algorithm, checksum: checksum}
+		fmt.Fprintf(w, "<CopyObjectResult><Checksum%[1]s>%[2]s</Checksum%[1]s></CopyObjectResult>", algorithm, checksum)
+	case r.Method == http.MethodPut:
+		sum, ok := f.checkBody(w, r, body)
+		if !ok {
+			return
+		}
+		f.objects[key] = fakeObject{data: body, algorithm: r.Header.Get("X-Amz-Sdk-Checksum-Algorithm"), checksum: sum}
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.data)))
+		if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" && object.checksum != "" {
+			w.Header().Set("X-Amz-Checksum-"+object.algorithm, object.checksum)
+		}
+		if r.Method == http.MethodGet {
+			w.Write(object.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+// withFakeS3 runs test with S3 storage on a fake S3 endpoint, whose parts are partSize bytes.
+// The storage sends checksums, as it does to S3 itself.
+func withFakeS3(t *testing.T, checksum string, partSize int64, test func(f *fakeS3, store *s3Storage)) {
+	for name, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":         "test",
+		"AWS_SECRET_ACCESS_KEY":     "test",
+		"AWS_EC2_METADATA_DISABLED": "true",
+	} {
+		previous, set := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if set {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	f := newFakeS3()
+	server := httptest.NewServer(f)
+	defer server.Close()
+	store := newS3Storage("clever-analytics", "exports", s3Options{endpoint: server.URL, pathStyle: true}, checksumAlgorithms[checksum])
+	store.partSize = partSize
+	store.serverChecksums = true
+	test(f, store)
+}
+
+func TestS3StorageWrite(t *testing.T) {
+	for _, checksum := range []string{"sha256", "crc32c"} {
+		withFakeS3(t, checksum, 1024, func(f *fakeS3, store *s3Storage) {
+			// bodies of more than one part are uploaded in parts
+			for size, parts := range map[int]string{0: "", 10: "", 1024: "", 2600: "-3"} {
+				data := bytes.Repeat([]byte("x"), size)
+				key := fmt.Sprintf("mongo_raw/students/%d.json.gz", size)
+				d, err := store.write(key, bytes.NewReader(data))
+				assert.NoError(t, err, "%s %d", checksum, size)
+				assert.Equal(t, checksum, d.algorithm)
+				object := f.objects["/clever-analytics/exports/"+key]
+				assert.True(t, strings.HasSuffix(object.checksum, parts), "%s %d: %s", checksum, size, object.checksum)
+				assert.Equal(t, parts != "", strings.Contains(object.checksum, "-"), "%s %d: %s", checksum, size, object.checksum)
+				written, err := store.read(key)
+				assert.NoError(t, err)
+				assert.Equal(t, data, written)
+
+				// moves are checked against the digest of the written file
+				assert.NoError(t, store.move(key, key+".moved", d), "%s %d", checksum, size)
+				_, err = store.read(key)
+				assert.Equal(t, errFileNotFound, err)
+			}
+		})
+	}
+}
+
+func TestS3StorageWriteWithoutServerChecksums(t *testing.T) {
+	withFakeS3(t, "sha256", 1024, func(f *fakeS3, store *s3Storage) {
+		f.rejectChecksums = true
+		store.serverChecksums = false
+		for _, size := range []int{10, 2600} {
+			data := bytes.Repeat([]byte("x"), size)
+			key := fmt.Sprintf("mongo_raw/students/%d.json.gz", size)
+			d, err := store.write(key, bytes.NewReader(data))
+			assert.NoError(t, err, "%d", size)
+			// the digest is still hashed while writing, for the manifest
+			assert.Equal(t, digest{algorithm: "sha256", value: fmt.Sprintf("%x", sha256.Sum256(data))}, d)
+			assert.NoError(t, store.move(key, key+".moved", d), "%d", size)
+			written, err := store.read(key + ".moved")
+			assert.NoError(t, err)
+			assert.Equal(t, data, written)
+		}
+	})
+}
+
+func TestS3StorageWriteFailure(t *testing.T) {
+	withFakeS3(t, "sha256", 1024, func(f *fakeS3, store *s3Storage) {
+		f.failParts = true
+		_, err := store.write("mongo_raw/students/a.json.gz", bytes.NewReader(make([]byte, 4000)))
+		assert.Error(t, err)
+		// the parts that were uploaded aren't left behind
+		assert.Equal(t, 1, f.aborted)
+		assert.Empty(t, f.uploads)
+	})
+}
+
+func TestFakeS3RequiresChecksums(t *testing.T) {
+	// what uploads that only name the algorithm get from S3
+	withFakeS3(t, "sha256", 1024, func(f *fakeS3, store *s3Storage) {
+		client, err := store.s3Client()
+		assert.NoError(t, err)
+		_, err = client.PutObject(&s3.PutObjectInput{
+			Body:              bytes.NewReader([]byte("abc")),
+			Bucket:            aws.String(store.bucket),
+			Key:               aws.String("a.json"),
+			ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmSha256),
+		})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "x-amz-sdk-checksum-algorithm specified")
+	})
+}
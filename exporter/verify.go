@@ -0,0 +1,121 @@
+package exporter
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	json "github.com/pquerna/ffjson/ffjson"
+)
+
+// FileCheck is the result of checking a file against its manifest entry
+type FileCheck struct {
+	File
+	// Err is why the file doesn't match the entry, or nil if it does
+	Err error
+}
+
+// Verify reads the manifest at manifestURL, an s3:// or file:// url, and checks that each
+// of its files is there with the size and digest the manifest records. The storage
+// options set how S3 is accessed.
+func Verify(manifestURL string, options StorageOptions) ([]FileCheck, error) {
+	stores := map[string]Storage{}
+	store, key, err := storageForURL(manifestURL, options, stores)
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.read(key)
+	if err != nil {
+		return nil, &StorageError{URL: manifestURL, Err: err}
+	}
+	manifest := Manifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %s", manifestURL, err)
+	}
+
+	checks := []FileCheck{}
+	for _, entry := range manifest.Entries {
+		check := FileCheck{}
+		check.URL, _ = entry["url"].(string)
+		meta, _ := entry["meta"].(map[string]interface{})
+		if length, ok := meta["content_length"].(float64); ok {
+			check.ContentLength = int64(length)
+		}
+		for name := range checksumAlgorithms {
+			if value, ok := meta[name].(string); ok {
+				check.DigestAlgorithm, check.Digest = name, value
+			}
+		}
+		check.Err = checkFile(check.File, options, stores)
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// checkFile reads the file and compares it against its manifest entry
+func checkFile(f File, options StorageOptions, stores map[string]Storage) error {
+	store, key, err := storageForURL(f.URL, options, stores)
+	if err != nil {
+		return err
+	}
+	r, err := store.open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var h hash.Hash
+	algorithm, hasDigest := checksumAlgorithms[f.DigestAlgorithm]
+	w := ioutil.Discard
+	if hasDigest {
+		h = algorithm.newHash()
+		w = h
+	}
+	size, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if size != f.ContentLength {
+		return fmt.Errorf("file is %d bytes, but the manifest has %d", size, f.ContentLength)
+	}
+	if hasDigest {
+		if d := algorithm.digest(h); d.value != f.Digest {
+			return fmt.Errorf("file has %s digest %s, but the manifest has %s", algorithm.name, d.value, f.Digest)
+		}
+	}
+	return nil
+}
+
+// storageForURL returns the storage of the bucket or file system the url is in, and the
+// url's key in it. Storages are shared through stores, so that each bucket's client is
+// only created once.
+func storageForURL(location string, options StorageOptions, stores map[string]Storage) (Storage, string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid url '%s': %s", location, err)
+	}
+	var root, key string
+	switch u.Scheme {
+	case "s3":
+		// s3 urls have the key as it is, unescaped, so e.g. the %2F of a partition value
+		// stays in the key
+		root = "s3://" + u.Host
+		key = strings.TrimPrefix(strings.TrimPrefix(location, root), "/")
+	case "file":
+		// file urls are escaped
+		root = "file:///"
+		key = strings.TrimPrefix(u.Path, "/")
+	default:
+		return nil, "", fmt.Errorf("url '%s' is neither s3:// nor file://", location)
+	}
+	store, ok := stores[root]
+	if !ok {
+		if store, err = NewStorage(root, options); err != nil {
+			return nil, "", err
+		}
+		stores[root] = store
+	}
+	return store, key, nil
+}
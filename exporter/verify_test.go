@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongo-to-s3")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := localStorage{dir: dir, checksum: checksumAlgorithms["sha256"]}
+
+	files := []dataFile{}
+	for _, name := range []string{"mongo_raw/students/a_0.json.gz", "mongo_raw/students/a_1.json.gz", "mongo_raw/students/a_2.json.gz"} {
+		d, err := uploadFile(strings.NewReader(name), store, name)
+		assert.NoError(t, err)
+		files = append(files, dataFile{Name: name, ContentLength: int64(len(name)), Digest: d})
+	}
+	manifest, err := createManifest(store, files)
+	assert.NoError(t, err)
+	_, err = uploadFile(manifest, store, "mongo_raw/students/a.manifest")
+	assert.NoError(t, err)
+	// one file changes after the export and another goes missing
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "mongo_raw/students/a_1.json.gz"), []byte("mongo_raw/students/b_1.json.gz"), 0644))
+	assert.NoError(t, store.remove("mongo_raw/students/a_2.json.gz"))
+
+	checks, err := Verify(store.url("mongo_raw/students/a.manifest"), StorageOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, checks, 3)
+	assert.Equal(t, store.url(files[0].Name), checks[0].URL)
+	assert.Equal(t, "sha256", checks[0].DigestAlgorithm)
+	assert.NoError(t, checks[0].Err)
+	assert.Error(t, checks[1].Err)
+	assert.Equal(t, errFileNotFound, checks[2].Err)
+
+	_, err = Verify(store.url("mongo_raw/students/b.manifest"), StorageOptions{})
+	assert.Error(t, err)
+	_, err = Verify("gs://clever-analytics/a.manifest", StorageOptions{})
+	assert.Error(t, err)
+}
+
+func TestStorageForURL(t *testing.T) {
+	stores := map[string]Storage{}
+	store, key, err := storageForURL("s3://clever-analytics/exports/district_id=a%2Fb%20c/a_0.json.gz", StorageOptions{}, stores)
+	assert.NoError(t, err)
+	assert.Equal(t, "exports/district_id=a%2Fb%20c/a_0.json.gz", key)
+	assert.Equal(t, "s3://clever-analytics/exports/district_id=a%2Fb%20c/a_0.json.gz", store.url(key))
+
+	local := localStorage{dir: "/tmp/exports", checksum: checksumAlgorithms["sha256"]}
+	store, key, err = storageForURL(local.url("district_id=a%2Fb%20c/a_0.json.gz"), StorageOptions{}, stores)
+	assert.NoError(t, err)
+	assert.Equal(t, "tmp/exports/district_id=a%2Fb%20c/a_0.json.gz", key)
+	assert.Equal(t, local.url("district_id=a%2Fb%20c/a_0.json.gz"), store.url(key))
+}
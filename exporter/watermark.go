@@ -0,0 +1,188 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+// watermark is the highest value of a table's incremental field that has been exported.
+// It's stored as extended JSON so that ObjectIds and dates survive the round trip.
+type watermark struct {
+	Field string      `bson:"field"`
+	Value interface{} `bson:"value"`
+}
+
+// formatWatermarkFilename returns the key of the watermark for a table. It lives next to
+// the exported data under the table's schema, outside of the dated prefixes, so every
+// run finds it.
+func formatWatermarkFilename(t config.Table) string {
+	return path.Join(t.Meta.SchemaName(), t.Destination, "_watermark.json")
+}
+
+// readWatermark fetches the watermark left by the previous run, or nil if there isn't one,
+// along with the file it was read from
+func readWatermark(store Storage, t config.Table) (*watermark, []byte, error) {
+	key := formatWatermarkFilename(t)
+	data, err := store.read(key)
+	if err == errFileNotFound {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	mark, err := unmarshalWatermark(data, key)
+	return mark, data, err
+}
+
+func unmarshalWatermark(data []byte, key string) (*watermark, error) {
+	mark := &watermark{}
+	if err := bson.UnmarshalExtJSON(data, false, mark); err != nil {
+		return nil, fmt.Errorf("invalid watermark %s: %s", key, err)
+	}
+	// compare against the same types the exported rows have
+	mark.Value = normalizeValue(mark.Value)
+	return mark, nil
+}
+
+func marshalWatermark(mark *watermark) ([]byte, error) {
+	return bson.MarshalExtJSON(mark, false, false)
+}
+
+// watermarkMove is an export's update of a table's watermark
+type watermarkMove struct {
+	key string
+	// previous is the watermark file it replaced, nil if there wasn't one
+	previous []byte
+}
+
+// restore puts back the watermark that was replaced, or removes the new one if there
+// wasn't one before
+func (m *watermarkMove) restore(store Storage) error {
+	if m.previous == nil {
+		return store.remove(m.key)
+	}
+	_, err := uploadFile(bytes.NewReader(m.previous), store, m.key)
+	return err
+}
+
+// query returns the filter selecting the documents from the watermark on. Documents at the
+// watermark are exported again, since more can be written with the same value after the
+// export read the field's highest value, and the load upserts them anyway.
+func (w *watermark) query() bson.M {
+	return bson.M{w.Field: bson.M{"$gte": w.Value}}
+}
+
+// watermarkTracker keeps the highest value of the incremental field seen during an export
+type watermarkTracker struct {
+	mu    sync.Mutex
+	field string
+	max   interface{}
+}
+
+func newWatermarkTracker(field string, previous *watermark) *watermarkTracker {
+	tracker := &watermarkTracker{field: field}
+	if previous != nil {
+		tracker.max = previous.Value
+	}
+	return tracker
+}
+
+// observe records the incremental field of a raw (not yet flattened) mongo row
+func (w *watermarkTracker) observe(r optimus.Row) {
+	val, ok := lookupPath(r, w.field)
+	if !ok || val == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.max == nil || watermarkLess(w.max, val) {
+		w.max = val
+	}
+}
+
+// watermark returns the new watermark, or nil if no value has ever been seen
+func (w *watermarkTracker) watermark() *watermark {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.max == nil {
+		return nil
+	}
+	return &watermark{Field: w.field, Value: w.max}
+}
+
+// lookupPath finds a dot-separated field in a nested row
+func lookupPath(r map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.SplitN(path, ".", 2)
+	val, ok := r[parts[0]]
+	if !ok || len(parts) == 1 {
+		return val, ok
+	}
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return lookupPath(v, parts[1])
+	case optimus.Row:
+		return lookupPath(v, parts[1])
+	}
+	return nil, false
+}
+
+// watermarkLess compares two values of the incremental field. Numbers compare as numbers
+// whatever their types, but other values of different types aren't comparable and are
+// never less than one another.
+func watermarkLess(a, b interface{}) bool {
+	switch av := a.(type) {
+	case primitive.ObjectID:
+		bv, ok := b.(primitive.ObjectID)
+		// ObjectIds are big-endian, so byte order is creation order
+		return ok && bytes.Compare(av[:], bv[:]) < 0
+	case time.Time:
+		bv, ok := b.(time.Time)
+		return ok && av.Before(bv)
+	case string:
+		bv, ok := b.(string)
+		return ok && av < bv
+	case int32, int64, float64:
+		return numberLess(a, b)
+	}
+	return false
+}
+
+// numberLess compares numbers of the types mongo stores them as. A field can hold int32s
+// in some documents and int64s or doubles in others, and watermarks read back from
+// extended JSON are int32s when they fit.
+func numberLess(a, b interface{}) bool {
+	ai, aInt := integerValue(a)
+	bi, bInt := integerValue(b)
+	if aInt && bInt {
+		return ai < bi
+	}
+	af, aOK := floatValue(a)
+	bf, bOK := floatValue(b)
+	return aOK && bOK && af < bf
+}
+
+func integerValue(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+func floatValue(v interface{}) (float64, bool) {
+	if n, ok := integerValue(v); ok {
+		return float64(n), true
+	}
+	n, ok := v.(float64)
+	return n, ok
+}
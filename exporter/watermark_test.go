@@ -0,0 +1,121 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/Clever/optimus.v3"
+)
+
+func TestWatermarkRoundTrip(t *testing.T) {
+	id, _ := primitive.ObjectIDFromHex("5a1b2c3d4e5f6a7b8c9d0e1f")
+	for _, val := range []interface{}{
+		id,
+		time.Date(2016, 1, 27, 21, 0, 0, 0, time.UTC),
+	} {
+		data, err := marshalWatermark(&watermark{Field: "updated_at", Value: val})
+		assert.NoError(t, err)
+
+		mark, err := unmarshalWatermark(data, "collection")
+		assert.NoError(t, err)
+		assert.Equal(t, &watermark{Field: "updated_at", Value: val}, mark)
+	}
+
+	// watermarks written before the move to the official driver
+	mark, err := unmarshalWatermark([]byte(`{"field":"_id","value":{"$oid":"5a1b2c3d4e5f6a7b8c9d0e1f"}}`), "collection")
+	assert.NoError(t, err)
+	assert.Equal(t, &watermark{Field: "_id", Value: id}, mark)
+}
+
+func TestFormatWatermarkFilename(t *testing.T) {
+	assert.Equal(t, "mongo_raw/students/_watermark.json", formatWatermarkFilename(config.Table{Destination: "students"}))
+	// tables of the same name in different schemas don't share a watermark
+	assert.Equal(t, "athena_raw/students/_watermark.json", formatWatermarkFilename(config.Table{Destination: "students", Meta: config.Meta{Schema: "athena_raw"}}))
+}
+
+func TestWatermarkQuery(t *testing.T) {
+	at := time.Date(2016, 1, 27, 21, 0, 0, 0, time.UTC)
+	mark := &watermark{Field: "updated_at", Value: at}
+	assert.Equal(t, bson.M{"updated_at": bson.M{"$gte": at}}, mark.query())
+}
+
+func TestWatermarkTracker(t *testing.T) {
+	older := time.Date(2016, 1, 27, 21, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	tracker := newWatermarkTracker("meta.updated_at", &watermark{Field: "meta.updated_at", Value: older})
+	tracker.observe(optimus.Row{"meta": optimus.Row{"updated_at": newer}})
+	tracker.observe(optimus.Row{"meta": map[string]interface{}{"updated_at": older}})
+	tracker.observe(optimus.Row{"other": "no watermark"})
+	assert.Equal(t, &watermark{Field: "meta.updated_at", Value: newer}, tracker.watermark())
+
+	assert.Nil(t, newWatermarkTracker("_id", nil).watermark())
+}
+
+func TestRestoreWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongo-to-s3")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := newStorage("file://"+filepath.ToSlash(dir), s3Options{}, checksumAlgorithms["sha256"])
+	assert.NoError(t, err)
+	table := config.Table{Destination: "students", Meta: config.Meta{IncrementalField: "_id"}}
+	e, err := New(WithTable(table), WithStorage(store))
+	assert.NoError(t, err)
+	key := formatWatermarkFilename(table)
+
+	// the previous watermark is put back
+	_, err = store.write(key, strings.NewReader("second"))
+	assert.NoError(t, err)
+	assert.NoError(t, e.RestoreWatermark(&Result{watermark: &watermarkMove{key: key, previous: []byte("first")}}))
+	data, err := store.read(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+
+	// tables that had no watermark go back to having none
+	assert.NoError(t, e.RestoreWatermark(&Result{watermark: &watermarkMove{key: key}}))
+	_, err = store.read(key)
+	assert.Equal(t, errFileNotFound, err)
+
+	// tables whose watermark didn't move are left alone
+	assert.NoError(t, e.RestoreWatermark(&Result{}))
+	assert.NoError(t, e.RestoreWatermark(nil))
+}
+
+func TestWatermarkLess(t *testing.T) {
+	first := primitive.NewObjectIDFromTimestamp(time.Unix(1000, 0))
+	second := primitive.NewObjectIDFromTimestamp(time.Unix(2000, 0))
+	assert.True(t, watermarkLess(first, second))
+	assert.False(t, watermarkLess(second, first))
+	assert.True(t, watermarkLess(int64(1), int64(2)))
+	// numbers compare whatever their types
+	assert.True(t, watermarkLess(int32(1), int64(2)))
+	assert.False(t, watermarkLess(int64(2), int32(1)))
+	assert.True(t, watermarkLess(int64(1), 1.5))
+	assert.True(t, watermarkLess(1.5, int32(2)))
+	assert.False(t, watermarkLess(int32(2), int64(2)))
+	assert.True(t, watermarkLess(int64(1<<53), int64(1<<53+1)))
+	// other different types never compare
+	assert.False(t, watermarkLess(1, "2"))
+	assert.False(t, watermarkLess(int64(1), "2"))
+}
+
+func TestWatermarkTrackerMixedNumbers(t *testing.T) {
+	// a watermark saved as an int64 that fits in an int32 is read back as an int32
+	data, err := marshalWatermark(&watermark{Field: "version", Value: int64(5)})
+	assert.NoError(t, err)
+	previous, err := unmarshalWatermark(data, "collection")
+	assert.NoError(t, err)
+
+	tracker := newWatermarkTracker("version", previous)
+	tracker.observe(optimus.Row{"version": int64(7)})
+	tracker.observe(optimus.Row{"version": 6.5})
+	assert.Equal(t, &watermark{Field: "version", Value: int64(7)}, tracker.watermark())
+}
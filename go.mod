@@ -9,8 +9,9 @@ require (
 	github.com/Clever/pathio v3.1.2-0.20160428201732-0e1d760e1bb1+incompatible
 	github.com/afex/hystrix-go v0.0.0-20180502004556-fa1af6a1f4f5 // indirect
 	github.com/asaskevich/govalidator v0.0.0-20200817114649-df4adffc9d8c // indirect
-	github.com/aws/aws-sdk-go v1.29.15
+	github.com/aws/aws-sdk-go v1.44.327
 	github.com/donovanhide/eventsource v0.0.0-20171031113327-3ed64d21fb0b // indirect
+	github.com/dsnet/compress v0.0.1
 	github.com/facebookgo/ensure v0.0.0-20200202191622-63f1cf65ac4c // indirect
 	github.com/facebookgo/errgroup v0.0.0-20160209021148-779c8d7ef069 // indirect
 	github.com/facebookgo/stack v0.0.0-20160209184415-751773369052 // indirect
@@ -20,20 +21,29 @@ require (
 	github.com/go-openapi/validate v0.19.11 // indirect
 	github.com/golang/mock v1.6.0 // indirect
 	github.com/google/go-cmp v0.5.4 // indirect
+	github.com/klauspost/compress v1.15.9
+	github.com/kr/text v0.2.0 // indirect
+	github.com/linkedin/goavro/v2 v2.11.1
 	github.com/mailru/easyjson v0.7.6 // indirect
 	github.com/mitchellh/mapstructure v1.3.3 // indirect
+	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/opentracing/opentracing-go v1.2.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.18
 	github.com/pquerna/ffjson v0.0.0-20180717144149-af8b230fcd20
 	github.com/smartystreets/goconvey v1.6.4 // indirect
-	github.com/stretchr/testify v1.6.1
+	github.com/stretchr/objx v0.2.0 // indirect
+	github.com/stretchr/testify v1.7.0
 	github.com/xeipuuv/gojsonpointer v0.0.0-20180127040702-4e3ac2762d5f // indirect
 	github.com/xeipuuv/gojsonreference v0.0.0-20180127040603-bd5ef7bd5415 // indirect
 	github.com/xeipuuv/gojsonschema v1.1.1-0.20190414155507-6c00ba4a5316 // indirect
-	go.mongodb.org/mongo-driver v1.4.1 // indirect
+	github.com/xitongsys/parquet-go v1.6.2
+	go.mongodb.org/mongo-driver v1.13.4
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/Clever/kayvee-go.v3 v3.0.0 // indirect
 	gopkg.in/Clever/kayvee-go.v6 v6.24.0
 	gopkg.in/Clever/optimus.v3 v3.7.0
+	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/fatih/set.v0 v0.1.0 // indirect
-	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 	gopkg.in/yaml.v2 v2.3.0
+	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776 // indirect
 )
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+
+	alcsWagClient "github.com/Clever/analytics-latency-config-service/gen-go/client"
+	alcs "github.com/Clever/analytics-latency-config-service/gen-go/models"
+	"github.com/Clever/analytics-util/analyticspipeline"
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/exporter"
+)
+
+// flagSource fills in the flags of an export run. flags is a pointer to a struct whose
+// string and bool fields are tagged with their flag names.
+type flagSource interface {
+	parse(flags interface{}) error
+}
+
+// freshnessChecker tells whether a table was loaded recently enough for the run to skip it
+type freshnessChecker interface {
+	isFresh(table config.Table) bool
+}
+
+// payloadEmitter hands what the run exported to whatever runs next. payload has the
+// fields s3-to-redshift is run with, and results what each table wrote.
+type payloadEmitter interface {
+	emit(payload map[string]interface{}, results []*exporter.Result) error
+}
+
+// integrations are what an export run needs from its surroundings
+type integrations struct {
+	flags     flagSource
+	freshness freshnessChecker
+	payload   payloadEmitter
+	// load is set when the payload is handed to s3-to-redshift, which loads the files
+	load bool
+}
+
+// pipelineIntegrations runs exports as a step of the analytics pipeline: flags come from
+// the worker's payload, fresh tables are skipped according to ALCS and the payload of the
+// next step is printed for gearman.
+func pipelineIntegrations() (integrations, error) {
+	client, err := alcsWagClient.NewFromDiscovery()
+	if err != nil {
+		return integrations{}, err
+	}
+	worker := &pipelineWorker{}
+	return integrations{flags: worker, freshness: alcsFreshness{client: client}, payload: worker, load: true}, nil
+}
+
+// pipelineWorker reads the flags from the analytics pipeline and adds the run's output to
+// the payload it was started with
+type pipelineWorker struct {
+	payload *analyticspipeline.Payload
+}
+
+func (w *pipelineWorker) parse(flags interface{}) error {
+	payload, err := analyticspipeline.AnalyticsWorker(flags)
+	if err != nil {
+		return err
+	}
+	w.payload = payload
+	return nil
+}
+
+func (w *pipelineWorker) emit(payload map[string]interface{}, results []*exporter.Result) error {
+	if w.payload.Current == nil {
+		w.payload.Current = map[string]interface{}{}
+	}
+	for key, value := range payload {
+		w.payload.Current[key] = value
+	}
+	analyticspipeline.PrintPayload(w.payload)
+	return nil
+}
+
+// alcsFreshness asks ALCS whether the prod redshift table is fresh
+type alcsFreshness struct {
+	client alcsWagClient.Client
+}
+
+func (f alcsFreshness) isFresh(table config.Table) bool {
+	return analyticspipeline.IsTableDataFresh(
+		log,
+		f.client,
+		alcs.AnalyticsDatabaseRedshiftProd,
+		table.Meta.SchemaName(),
+		table.Destination,
+	)
+}
+
+// standaloneRequested reports whether args ask for a standalone run
+func standaloneRequested(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "-standalone", "--standalone", "-standalone=true", "--standalone=true":
+			return true
+		}
+	}
+	return false
+}
+
+// standaloneIntegrations runs exports without the analytics pipeline, discovery or ALCS:
+// flags are parsed from args, every table is exported and the result is written as JSON
+// to stdout, or to the -output file.
+func standaloneIntegrations(args []string) integrations {
+	s := &standalone{args: args}
+	return integrations{flags: s, freshness: neverFresh{}, payload: s}
+}
+
+// standalone parses plain command line flags and writes the run's result as JSON
+type standalone struct {
+	args   []string
+	output string
+}
+
+func (s *standalone) parse(flags interface{}) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.Bool("standalone", true, "Run without the analytics pipeline")
+	fs.StringVar(&s.output, "output", "", "File to write the JSON result to instead of stdout")
+	v := reflect.ValueOf(flags).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("config")
+		if name == "" {
+			continue
+		}
+		// the fields' values are the defaults
+		switch field := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			fs.StringVar(field, name, *field, "")
+		case *bool:
+			fs.BoolVar(field, name, *field, "")
+		default:
+			return fmt.Errorf("flag %s has unsupported type %T", name, field)
+		}
+	}
+	return fs.Parse(s.args)
+}
+
+func (s *standalone) emit(payload map[string]interface{}, results []*exporter.Result) error {
+	output := map[string]interface{}{}
+	for key, value := range payload {
+		output[key] = value
+	}
+	if results == nil {
+		results = []*exporter.Result{}
+	}
+	output["results"] = results
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if s.output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(s.output, data, 0644)
+}
+
+// neverFresh exports every table, since standalone runs have nothing to debounce against
+type neverFresh struct{}
+
+func (neverFresh) isFresh(config.Table) bool {
+	return false
+}
@@ -1,60 +1,34 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/Clever/mongo-to-s3/cluster"
 	"github.com/Clever/mongo-to-s3/config"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/Clever/mongo-to-s3/exporter"
 	"gopkg.in/Clever/kayvee-go.v6/logger"
 
-	json "github.com/pquerna/ffjson/ffjson"
-
-	alcsWagClient "github.com/Clever/analytics-latency-config-service/gen-go/client"
-	alcs "github.com/Clever/analytics-latency-config-service/gen-go/models"
-	"github.com/Clever/analytics-util/analyticspipeline"
 	"github.com/Clever/discovery-go"
-	"github.com/Clever/pathio"
-	"gopkg.in/Clever/optimus.v3"
-	jsonsink "gopkg.in/Clever/optimus.v3/sinks/json"
-	mongosource "gopkg.in/Clever/optimus.v3/sources/mongo"
-	"gopkg.in/Clever/optimus.v3/transformer"
-	"gopkg.in/Clever/optimus.v3/transforms"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 var (
-	log            = logger.New("mongo-to-s3")
-	configs        map[string]string
-	mongoURLs      map[string]string
-	mongoUsernames map[string]string
-	mongoPasswords map[string]string
-	usesAtlasMap   map[string]bool
-	alcsClient     alcsWagClient.Client
+	log          = logger.New("mongo-to-s3")
+	usesAtlasMap map[string]bool
 )
 
-// getEnv looks up an environment variable given and exits if it does not exist.
-func getEnv(envVar string) string {
-	val := os.Getenv(envVar)
-	if val == "" {
-		log.ErrorD("env-variable-not-specified-error", logger.M{"variable": envVar})
-		os.Exit(1)
-	}
-	return val
-}
+// exitAborted is the exit code of runs stopped by SIGINT or SIGTERM, so that they can be
+// told apart from runs that failed
+const exitAborted = 3
 
 func generateServiceEndpoint(user, pass, path string) string {
 	hostPort, err := discovery.HostPort("gearman-admin", "http")
@@ -71,93 +45,6 @@ func generateServiceEndpoint(user, pass, path string) string {
 	return fmt.Sprintf("%s://%s:%s@%s%s", proto, user, pass, hostPort, path)
 }
 
-func init() {
-	configs = map[string]string{
-		"il":           getEnv("IL_CONFIG"),
-		"il_user":      getEnv("IL_USER_CONFIG"),
-		"sis":          getEnv("SIS_CONFIG"),
-		"sis_read":     getEnv("SIS_READ_CONFIG"),
-		"app_sis":      getEnv("APP_SIS_CONFIG"),
-		"app_sis_read": getEnv("APP_SIS_READ_CONFIG"),
-		"legacy":       getEnv("LEGACY_CONFIG"),
-		"legacy_read":  getEnv("LEGACY_READ_CONFIG"),
-		"misc":         getEnv("MISC_CONFIG"),
-	}
-	mongoURLs = map[string]string{
-		"il":           getEnv("IL_URL"),
-		"il_user":      getEnv("IL_USER_URL"),
-		"sis":          getEnv("SIS_URL"),
-		"sis_read":     getEnv("SIS_READ_URL"),
-		"app_sis":      getEnv("APP_SIS_URL"),
-		"app_sis_read": getEnv("APP_SIS_READ_URL"),
-		"legacy":       getEnv("LEGACY_URL"),
-		"legacy_read":  getEnv("LEGACY_READ_URL"),
-		"misc":         getEnv("MISC_URL"),
-	}
-	mongoUsernames = map[string]string{
-		"il":           getEnv("IL_USERNAME"),
-		"il_user":      getEnv("IL_USER_USERNAME"),
-		"sis":          getEnv("SIS_USERNAME"),
-		"sis_read":     getEnv("SIS_READ_USERNAME"),
-		"app_sis":      getEnv("APP_SIS_USERNAME"),
-		"app_sis_read": getEnv("APP_SIS_READ_USERNAME"),
-		"legacy":       getEnv("LEGACY_USERNAME"),
-		"legacy_read":  getEnv("LEGACY_READ_USERNAME"),
-		"misc":         getEnv("MISC_USERNAME"),
-	}
-	mongoPasswords = map[string]string{
-		"il":           getEnv("IL_PASSWORD"),
-		"il_user":      getEnv("IL_USER_PASSWORD"),
-		"sis":          getEnv("SIS_PASSWORD"),
-		"sis_read":     getEnv("SIS_READ_PASSWORD"),
-		"app_sis":      getEnv("APP_SIS_PASSWORD"),
-		"app_sis_read": getEnv("APP_SIS_READ_PASSWORD"),
-		"legacy":       getEnv("LEGACY_PASSWORD"),
-		"legacy_read":  getEnv("LEGACY_READ_PASSWORD"),
-		"misc":         getEnv("MISC_PASSWORD"),
-	}
-}
-
-func mongoConnection(url string) *mgo.Session {
-	s, err := mgo.DialWithTimeout(url, 10*time.Minute)
-	if err != nil {
-		log.ErrorD("mongo-dial-error", logger.M{"error": err.Error()})
-		os.Exit(1)
-	}
-	s.SetMode(mgo.Primary, true)
-	return s
-}
-
-func mongoAtlasConnection(url string, username string, password string) (*mgo.Session, error) {
-	log.InfoD("mongo-connection-call", logger.M{"url": url})
-	dialInfo, err := mgo.ParseURL(url)
-	if err != nil {
-		log.ErrorD("mongo-parse-url-error", logger.M{"error": err.Error()})
-		return nil, err
-	}
-
-	dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
-		return tls.Dial("tcp", addr.String(), &tls.Config{})
-	}
-	if username != "" {
-		log.Info("mongo-username-set")
-		dialInfo.Username = username
-		if password != "" {
-			log.Info("mongo-password-set")
-			dialInfo.Password = password
-		}
-	}
-
-	session, err := mgo.DialWithInfo(dialInfo)
-	if err != nil {
-		log.ErrorD("mongo-dial-error", logger.M{"error": err.Error()})
-		return nil, err
-	}
-	log.Info("mongo-dial-successful")
-	session.SetMode(mgo.Nearest, true)
-	return session, nil
-}
-
 // parseConfigString takes in a config from an env var
 func parseConfigString(conf string) config.Config {
 	configYaml, err := config.ParseYAML([]byte(conf))
@@ -165,328 +52,449 @@ func parseConfigString(conf string) config.Config {
 		log.ErrorD("config-parse-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
+	for key, table := range configYaml {
+		for _, warning := range table.Warnings() {
+			log.WarnD("config-column-warning", logger.M{"table": key, "warning": warning})
+		}
+	}
 
 	return configYaml
 }
 
-func configuredOptimusTable(s *mgo.Session, table config.Table) optimus.Table {
-	fields := bson.M{}
-	if table.Meta.UseProjectionOptimization == true {
-		// Create a projection to only pull the fields we're interested in
-		for _, f := range table.Fields {
-			if f.Source != "" {
-				fields[f.Source] = 1
+// parseEncryption returns the encryption the flags describe
+func parseEncryption(encryptionType, kmsKeyID, kmsContext string, bucketKey bool) (config.Encryption, error) {
+	e := config.Encryption{Type: encryptionType, KMSKeyID: kmsKeyID, BucketKey: bucketKey}
+	if kmsContext != "" {
+		e.Context = map[string]string{}
+		for _, pair := range strings.Split(kmsContext, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return e, fmt.Errorf("invalid kmsContext pair '%s', expected key=value", pair)
 			}
+			e.Context[parts[0]] = parts[1]
 		}
 	}
-
-	collection := s.DB("").C(table.Source)
-	iter := collection.Find(nil).Batch(1000).Prefetch(0.75).Select(fields).Iter()
-	return mongosource.New(iter)
-}
-
-func formatFilename(timestamp, collectionName, fileIndex, extension string) string {
-	if fileIndex != "" {
-		// add underscore for readability
-		fileIndex = fmt.Sprintf("_%s", fileIndex)
-	}
-	t, _ := time.Parse(time.RFC3339, timestamp)
-	filePath := fmt.Sprintf("mongo_raw/%s/_data_timestamp_year=%02d/_data_timestamp_month=%02d/_data_timestamp_day=%02d/",
-		collectionName, t.Year(), int(t.Month()), t.Day())
-	fileName := fmt.Sprintf("mongo_raw_%s_%s%s%s", collectionName, timestamp, fileIndex, extension)
-	return filePath + fileName
+	return e, e.Validate()
 }
 
-func exportData(source optimus.Table, table config.Table, sink optimus.Sink, timestamp string) (int, error) {
-	rows := 0
-	datePopulator := config.GetPopulateDateFn(table.Meta.DataDateColumn, timestamp)
-	existentialTransformer := config.GetExistentialTransformerFn(table)
-	err := transformer.New(source).Map(config.Flattener()).
-		Map(existentialTransformer). // convert PII to boolean exists or not
-		Fieldmap(table.FieldMap()).
-		Map(datePopulator). // add in the _data_timestamp, etc
-		Map(func(d optimus.Row) (optimus.Row, error) {
-			rows = rows + 1
-			return d, nil
-		}).Sink(sink)
-	return rows, err
-}
-
-func copyConfigFile(bucket, timestamp, data, configName string) string {
-	// config_name is parsed from the input path b/c we have a different configs`
-	// get the yaml file at the end of the path
-	outPath := formatFilename(timestamp, configName, "", ".yml")
-	if bucket != "" {
-		outPath = fmt.Sprintf("s3://%s/%s", bucket, outPath)
+func main() {
+	if len(os.Args) > 1 {
+		if os.Args[1] == "export" {
+			// export's flags are read from os.Args, so they must follow the program name
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		} else if c, ok := commands[os.Args[1]]; ok {
+			runCommand(os.Args[1], c, os.Args[2:])
+			return
+		}
 	}
-	log.InfoD("conf-file-upload", logger.M{"path": outPath})
-	err := pathio.Write(outPath, []byte(data))
+	if standaloneRequested(os.Args[1:]) {
+		// stdout is left for the result
+		log.SetOutput(os.Stderr)
+		exporter.SetLogOutput(os.Stderr)
+		runExport(standaloneIntegrations(os.Args[1:]))
+		return
+	}
+	pipeline, err := pipelineIntegrations()
 	if err != nil {
-		log.ErrorD("output-file-write-error", logger.M{"error": err.Error()})
+		log.ErrorD("alcs-connect-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
-	return outPath
+	runExport(pipeline)
 }
 
-// uploadFile handles the awkwardness around s3 regions to upload the file
-// it takes in a reader for maximum flexibility
-func uploadFile(reader io.Reader, bucket, outputName string) {
-	s3Path := fmt.Sprintf("s3://%s/%s", bucket, outputName)
-	log.InfoD("uploading-file", logger.M{"filename": outputName, "path": s3Path})
-	region, err := getRegionForBucket(bucket)
-	if err != nil {
-		log.ErrorD("bucket-region-retrieval-error", logger.M{"error": err.Error()})
+// runExport exports the tables the flags select, and emits what it exported
+func runExport(run integrations) {
+	flags := struct {
+		Name string `config:"config"`
+		// ConfigFile is the path (local or s3://) of a config to use instead of the cluster's
+		ConfigFile   string `config:"configFile"`
+		Collection   string `config:"collection"`
+		Bucket       string `config:"bucket"`   // a bucket name, s3://bucket/prefix or file:///directory
+		NumFiles     string `config:"numfiles"` // configure library doesn't support ints or floats
+		SkipDebounce bool   `config:"skipDebounce"`
+		// Mode is either snapshot, which exports the collection once, or cdc, which streams
+		// changes to the collection until stopped
+		Mode          string `config:"mode"`
+		FlushInterval string `config:"flushInterval"` // how long cdc buckets are, e.g. 15m
+		// AllTables exports every table in the config instead of just Collection,
+		// Concurrency of them at a time
+		AllTables   bool   `config:"allTables"`
+		Concurrency string `config:"concurrency"`
+		// Compression and CompressionLevel are the codec and level for json, csv and tsv
+		// tables that don't set their own
+		Compression      string `config:"compression"`
+		CompressionLevel string `config:"compressionLevel"`
+		// MaxFileMB and MaxFileRows roll snapshot output over to a new file once the current
+		// one reaches that many compressed megabytes or rows. 0 means no limit.
+		MaxFileMB   string `config:"maxFileMB"`
+		MaxFileRows string `config:"maxFileRows"`
+		// KeyLayout is the layout of the S3 keys of tables that don't set their own: redshift,
+		// hive, flat or a template
+		KeyLayout string `config:"keyLayout"`
+		// S3Endpoint, S3PathStyle and S3Region point the S3 client at an S3 compatible store
+		// like MinIO. Setting S3Region skips looking up the bucket's region.
+		S3Endpoint  string `config:"s3Endpoint"`
+		S3PathStyle bool   `config:"s3PathStyle"`
+		S3Region    string `config:"s3Region"`
+		// Encryption is how objects are encrypted unless their table sets its own: aes256
+		// (SSE-S3) or kms (SSE-KMS) with an optional KMSKeyID, KMSContext of comma-separated
+		// key=value pairs and BucketKey
+		Encryption string `config:"encryption"`
+		KMSKeyID   string `config:"kmsKeyId"`
+		KMSContext string `config:"kmsContext"`
+		BucketKey  bool   `config:"bucketKey"`
+		// Checksum is the algorithm uploads are checked with and manifests record digests
+		// of: sha256 or crc32c
+		Checksum string `config:"checksum"`
+		// Stage writes data files under a staging prefix and only moves them into place once
+		// the export has succeeded
+		Stage bool `config:"stage"`
+	}{ // specifying default values:
+		Name:             "",
+		Collection:       "",
+		Bucket:           "TODO",
+		NumFiles:         "1",
+		SkipDebounce:     false,
+		Mode:             "snapshot",
+		FlushInterval:    "15m",
+		AllTables:        false,
+		Concurrency:      "2",
+		Compression:      "",
+		CompressionLevel: "0",
+		MaxFileMB:        "0",
+		MaxFileRows:      "0",
+		KeyLayout:        exporter.DefaultKeyLayout,
+		S3Endpoint:       "",
+		S3PathStyle:      false,
+		S3Region:         "",
+		Encryption:       config.EncryptionAES256,
+		KMSKeyID:         "",
+		KMSContext:       "",
+		BucketKey:        false,
+		Checksum:         exporter.DefaultChecksum,
+		Stage:            true,
+	}
+
+	if err := run.flags.parse(&flags); err != nil {
+		log.ErrorD("flags-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
-	log.InfoD("bucket-region-found", logger.M{"region": region})
 
-	// required to do this since we can't pipe together the gzip output and pathio, unfortunately
-	// TODO: modify Pathio so that we can support io.Pipe and use Pathio here: https://clever.atlassian.net/browse/IP-353
-	// from https://github.com/aws/aws-sdk-go/wiki/Getting-Started-Common-Examples
-	session := session.New()
-	client := s3.New(session, aws.NewConfig().WithRegion(region))
-	uploader := s3manager.NewUploaderWithClient(client)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Body:                 reader,
-		Bucket:               aws.String(bucket),
-		Key:                  aws.String(outputName),
-		ServerSideEncryption: aws.String("AES256"),
-	})
+	numFiles, err := strconv.Atoi(flags.NumFiles)
 	if err != nil {
-		log.ErrorD("s3-upload-error", logger.M{"path": s3Path, "error": err})
+		log.ErrorD("num-files-atoi-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
-}
-
-// EntryArray is a convenience function for JSON marshalling
-type EntryArray []map[string]interface{}
-
-// Manifest represents an s3 manifest file used to download to redshift
-// really only useful for JSON marshalling
-type Manifest struct {
-	Entries EntryArray `json:"entries"`
-}
-
-// createManifest creates a manifest file given the list of files to include into the file
-// it returns a reader for convenience
-// looks something like:
-//  { "entries": [
-//    {"url": "s3://clever-analytics/mongo_students_1_2016-01-27T21:00:00Z.json.gz", "mandatory": true},
-//    {"url": "s3://clever-analytics/mongo_students_2_2016-01-27T21:00:00Z.json.gz", "mandatory": true}
-//  ] }
-func createManifest(bucket string, dataFilenames []string) (io.Reader, error) {
-	var entryArray EntryArray
-	for _, fn := range dataFilenames {
-		entryArray = append(entryArray, map[string]interface{}{
-			"url":       fmt.Sprintf("s3://%s/%s", bucket, fn),
-			"mandatory": true,
-		})
+	if numFiles < 1 {
+		log.ErrorD("output-files-number-error", logger.M{"error": "Must specify a number of output file parts >= 1"})
+		os.Exit(1)
 	}
-
-	jsonVal, err := json.Marshal(Manifest{Entries: entryArray})
-	if err != nil {
-		return nil, err
+	concurrency, err := strconv.Atoi(flags.Concurrency)
+	if err != nil || concurrency < 1 {
+		log.ErrorD("concurrency-error", logger.M{"error": "Must specify a concurrency >= 1", "concurrency": flags.Concurrency})
+		os.Exit(1)
 	}
-	log.InfoD("manifest-file-contents", logger.M{"value": string(jsonVal)})
-	return bytes.NewReader(jsonVal), nil
-}
-
-func main() {
-	alcsClient, err := alcsWagClient.NewFromDiscovery()
+	compressionLevel, err := strconv.Atoi(flags.CompressionLevel)
 	if err != nil {
-		log.ErrorD("alcs-connect-error", logger.M{"error": err.Error()})
+		log.ErrorD("compression-level-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
-
-	flags := struct {
-		Name         string `config:"config"`
-		Collection   string `config:"collection"`
-		Bucket       string `config:"bucket"`
-		NumFiles     string `config:"numfiles"` // configure library doesn't support ints or floats
-		SkipDebounce bool   `config:"skipDebounce"`
-	}{ // specifying default values:
-		Name:         "",
-		Collection:   "",
-		Bucket:       "TODO",
-		NumFiles:     "1",
-		SkipDebounce: false,
+	maxFileMB, err := strconv.ParseInt(flags.MaxFileMB, 10, 64)
+	if err != nil || maxFileMB < 0 {
+		log.ErrorD("max-file-mb-error", logger.M{"error": "Must specify a maxFileMB >= 0", "maxFileMB": flags.MaxFileMB})
+		os.Exit(1)
 	}
-
-	nextPayload, err := analyticspipeline.AnalyticsWorker(&flags)
-	if err != nil {
-		log.ErrorD("analyticspipeline-error", logger.M{"error": err.Error()})
+	maxFileRows, err := strconv.ParseInt(flags.MaxFileRows, 10, 64)
+	if err != nil || maxFileRows < 0 {
+		log.ErrorD("max-file-rows-error", logger.M{"error": "Must specify a maxFileRows >= 0", "maxFileRows": flags.MaxFileRows})
 		os.Exit(1)
 	}
 
-	numFiles, err := strconv.Atoi(flags.NumFiles)
+	encryption, err := parseEncryption(flags.Encryption, flags.KMSKeyID, flags.KMSContext, flags.BucketKey)
 	if err != nil {
-		log.ErrorD("num-files-atoi-error", logger.M{"error": err.Error()})
+		log.ErrorD("encryption-flag-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
-	if numFiles < 1 {
-		log.ErrorD("output-files-number-error", logger.M{"error": "Must specify a number of output file parts >= 1"})
+	store, err := exporter.NewStorage(flags.Bucket, exporter.StorageOptions{
+		Endpoint:   flags.S3Endpoint,
+		PathStyle:  flags.S3PathStyle,
+		Region:     flags.S3Region,
+		Checksum:   flags.Checksum,
+		Encryption: encryption,
+	})
+	if err != nil {
+		log.ErrorD("storage-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
-
 	// Times are rounded down to the nearest hour
-	timestamp := time.Now().UTC().Add(-1 * time.Hour / 2).Round(time.Hour).Format(time.RFC3339)
+	now := time.Now()
+	timestamp := exporter.RunTimestamp(now)
+	// the options every table of the run shares
+	runOptions := []exporter.Option{
+		exporter.WithStorage(store),
+		exporter.WithCluster(flags.Name),
+		exporter.WithTimestamp(timestamp),
+		exporter.WithRunID(exporter.RunID(now)),
+		exporter.WithKeyLayout(flags.KeyLayout),
+		exporter.WithStaging(flags.Stage),
+		exporter.WithNumFiles(numFiles),
+		exporter.WithFileLimits(maxFileMB*1024*1024, maxFileRows),
+		exporter.WithCompression(flags.Compression, compressionLevel),
+	}
+	tableOptions := func(table config.Table, opts ...exporter.Option) []exporter.Option {
+		return append(append([]exporter.Option{exporter.WithTable(table)}, runOptions...), opts...)
+	}
+
+	// only the selected cluster is resolved, so other clusters' settings can be missing
+	mongoCluster, err := cluster.LookupWithConfig(flags.Name, flags.ConfigFile)
+	if err != nil {
+		log.ErrorD("invalid-config-error", logger.M{"error": err.Error()})
+		os.Exit(1)
+	}
+	configYaml := parseConfigString(mongoCluster.Config)
+	for key, table := range configYaml {
+		if _, err := exporter.New(tableOptions(table)...); err != nil {
+			log.ErrorD("table-options-error", logger.M{"table": key, "error": err.Error()})
+			os.Exit(1)
+		}
+	}
+	// config_name is parsed from the input path b/c we have a different configs`
+	confFileName, err := exporter.CopyConfig(flags.Name, mongoCluster.Config, runOptions...)
+	if err != nil {
+		log.ErrorD("s3-upload-error", logger.M{"error": err.Error()})
+		os.Exit(1)
+	}
 
-	c, ok := configs[flags.Name]
-	if !ok {
-		log.Error("invalid-config-error")
+	// the config keys of the tables to export
+	tableKeys := []string{}
+	if flags.AllTables {
+		for key := range configYaml {
+			tableKeys = append(tableKeys, key)
+		}
+		sort.Strings(tableKeys)
+		log.InfoD("all-tables-specified", logger.M{"collections": tableKeys})
+	} else {
+		if flags.Collection == "" {
+			log.Error("no-collection-specified")
+			os.Exit(1)
+		}
+		log.InfoD("collection-specified", logger.M{"collection": flags.Collection})
+		if _, ok := configYaml[flags.Collection]; !ok {
+			log.ErrorD("config-table-not-found", logger.M{"key": flags.Collection})
+			os.Exit(1)
+		}
+		tableKeys = append(tableKeys, flags.Collection)
+	}
+	upsert, err := upsertTables(configYaml, tableKeys)
+	if err != nil {
+		log.ErrorD("mixed-incremental-tables-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
-	configYaml := parseConfigString(c)
-	confFileName := copyConfigFile(flags.Bucket, timestamp, c, flags.Name)
+	// runs whose payload goes to s3-to-redshift can only export tables it can load
+	for _, key := range tableKeys {
+		if _, err := exporter.New(tableOptions(configYaml[key], exporter.WithRedshiftLoad(run.load))...); err != nil {
+			log.ErrorD("compression-load-error", logger.M{"table": key, "error": err.Error()})
+			os.Exit(1)
+		}
+	}
 
-	if flags.Collection == "" {
-		log.Error("no-collection-specified")
+	mongoURL, err := mongoCluster.ConnectionURL()
+	if err != nil {
+		log.ErrorD("mongo-url-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
+	mongoUsername, mongoPassword := mongoCluster.Username, mongoCluster.Password
 
-	log.InfoD("collection-specified", logger.M{"collection": flags.Collection})
+	// SIGINT and SIGTERM stop the run. Snapshot exports are aborted, cleaning up the files
+	// they have written, and change streams flush their open file.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	sourceTable, ok := configYaml[flags.Collection]
-	if !ok {
-		log.ErrorD("config-table-not-found", logger.M{"key": flags.Collection})
+	if flags.Mode == "cdc" {
+		if len(tableKeys) != 1 {
+			log.Error("cdc-mode-requires-one-collection")
+			os.Exit(1)
+		}
+		interval, err := time.ParseDuration(flags.FlushInterval)
+		if err != nil {
+			log.ErrorD("flush-interval-parse-error", logger.M{"error": err.Error()})
+			os.Exit(1)
+		}
+		db, err := exporter.Connect(context.Background(), mongoURL, mongoUsername, mongoPassword)
+		if err != nil {
+			log.ErrorD("mongo-connection-error", logger.M{"error": err.Error()})
+			os.Exit(1)
+		}
+		log.Info("mongo-connection-successful")
+		e, err := exporter.New(tableOptions(configYaml[tableKeys[0]], exporter.WithDatabase(db))...)
+		if err != nil {
+			log.ErrorD("table-options-error", logger.M{"error": err.Error()})
+			os.Exit(1)
+		}
+		if err := e.Stream(ctx, interval); err != nil {
+			log.ErrorD("change-stream-error", logger.M{"error": err.Error()})
+			os.Exit(1)
+		}
+		return
+	} else if flags.Mode != "snapshot" {
+		log.ErrorD("invalid-mode-error", logger.M{"mode": flags.Mode})
 		os.Exit(1)
 	}
 
-	// For now, all tables are loaded into mongo_raw.
-	// If this changes, we should pass it in as a parameter, or pull it from the next payload.
-	schema := "mongo_raw"
-
 	// After doing config validations, we can check for debouncing
-	if !flags.SkipDebounce {
-		isFresh := analyticspipeline.IsTableDataFresh(
-			log,
-			alcsClient,
-			alcs.AnalyticsDatabaseRedshiftProd,
-			schema,
-			sourceTable.Destination,
-		)
-		if isFresh {
-			// Augment next payload to indicate that we should skip the load.
-			nextPayload.Current["skipLoad"] = true
-			// Required field for s3-to-redshift. This will fail later parsing, but appease the flag parser
-			nextPayload.Current["date"] = "N/A"
-
-			// bounce out early
-			analyticspipeline.PrintPayload(nextPayload)
-			return
+	tables := []config.Table{}
+	for _, key := range tableKeys {
+		sourceTable := configYaml[key]
+		if !flags.SkipDebounce && run.freshness.isFresh(sourceTable) {
+			log.InfoD("table-data-fresh", logger.M{"table": sourceTable.Destination})
+			continue
 		}
+		tables = append(tables, sourceTable)
+	}
+	if len(tables) == 0 {
+		// Augment next payload to indicate that we should skip the load.
+		// date is required by s3-to-redshift. This will fail later parsing, but appease the flag parser
+		emitPayload(run, map[string]interface{}{"skipLoad": true, "date": "N/A"}, nil)
+		return
 	}
 
-	mongoURL := mongoURLs[flags.Name]
-	mongoUsername, ok := mongoUsernames[flags.Name]
-	mongoPassword, ok := mongoPasswords[flags.Name]
-	var mongoClient *mgo.Session
-
-	mongoClient, err = mongoAtlasConnection(mongoURL, mongoUsername, mongoPassword)
+	mongoDB, err := exporter.Connect(ctx, mongoURL, mongoUsername, mongoPassword)
 	if err != nil {
 		log.ErrorD("mongo-connection-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
 	log.Info("mongo-connection-successful")
 
-	// add name to list for submitting to next step in pipeline
-	outputTableName := sourceTable.Destination
-	outputFilenames := []string{}
-
-	// verify total rows match sum of written
-	var totalSummedRows int64
-	var totalMongoRows int64
-
-	mongoSource := configuredOptimusTable(mongoClient, sourceTable)
-	mongoSource = optimus.Transform(mongoSource, transforms.Each(func(d optimus.Row) error {
-		totalMongoRows++
-		if totalMongoRows%1000000 == 0 {
-			log.InfoD("processing-mongo-row", logger.M{"numRows": totalMongoRows})
+	// every table shares the one connection pool
+	exporters := []*exporter.Exporter{}
+	for _, table := range tables {
+		e, err := exporter.New(tableOptions(table, exporter.WithDatabase(mongoDB))...)
+		if err != nil {
+			log.ErrorD("table-options-error", logger.M{"table": table.Destination, "error": err.Error()})
+			os.Exit(1)
 		}
-		return nil
-	}))
-
-	// we want to split up the file for performance reasons
-	var waitGroup sync.WaitGroup
-	waitGroup.Add(numFiles)
-	for i := 0; i < numFiles; i++ {
-		outputName := formatFilename(timestamp, sourceTable.Destination, strconv.Itoa(i), ".json.gz")
-		outputFilenames = append(outputFilenames, outputName)
-		log.InfoD("outputting-file", logger.M{"file-number": i, "location": outputName})
-
-		// Gzip output into pipe so that we don't need to store locally
-		reader, writer := io.Pipe()
-		go func(index int) {
-			zippedOutput, _ := gzip.NewWriterLevel(writer, gzip.BestSpeed) // sorcery
-			if err != nil {
-				log.ErrorD("compression-level-error", logger.M{"error": err.Error()})
-				os.Exit(1)
-			}
-
-			sink := jsonsink.New(zippedOutput)
-			// ALWAYS close the gzip first
-			// (defer does LIFO)
-			defer writer.Close()
-			defer zippedOutput.Close()
-
-			count, err := exportData(mongoSource, sourceTable, sink, timestamp)
-			if err != nil {
-				log.ErrorD("table-read-error", logger.M{"error": err.Error()})
-				os.Exit(1)
-			}
-			log.InfoD("output-destination", logger.M{"collection": sourceTable.Destination, "count": count, "fileIndex": index})
-			// need to do this atomically to avoid concurrency issues
-			atomic.AddInt64(&totalSummedRows, int64(count))
-		}(i)
-
-		// Upload file to bucket
-		// need to put in own goroutine to kick off because exportData can't start and the reader can't close
-		// until we hook up the reader to a sink via uploadFile
-		// can't just put without goroutine because then only one iteration of the loop gets to run
-		go func() {
-			defer waitGroup.Done()
-			uploadFile(reader, flags.Bucket, outputName)
-		}()
+		exporters = append(exporters, e)
 	}
-	waitGroup.Wait()
-	log.InfoD("output-total", logger.M{"rows": totalSummedRows, "files": numFiles})
-	if totalSummedRows != totalMongoRows {
-		log.ErrorD("rows-written-read-mismatch-error", logger.M{"written": totalMongoRows, "read": totalSummedRows})
+	results, err := exportTables(ctx, exporters, concurrency)
+	if err != nil {
+		// no payload is emitted, so the files of the tables that were exported won't be
+		// loaded, and the next run has to export their documents again
+		restoreWatermarks(exporters, results)
+	}
+	if errors.Is(err, exporter.ErrAborted) {
+		log.Warn("run-aborted")
+		os.Exit(exitAborted)
+	} else if err != nil {
+		log.ErrorD("export-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
-	// we always upload a manifest including the files we just created
-	manifestFilename := formatFilename(timestamp, sourceTable.Destination, "", ".manifest")
-	manifestReader, err := createManifest(flags.Bucket, outputFilenames)
-	if err != nil {
-		log.ErrorD("manifest-create-error", logger.M{"error": err.Error()})
+
+	emitPayload(run, nextPayload(results, confFileName, timestamp, upsert), results)
+}
+
+// nextPayload returns the payload of the s3-to-redshift job that loads the tables of results
+func nextPayload(results []*exporter.Result, confFileName, timestamp string, upsert bool) map[string]interface{} {
+	// add names to list for submitting to next step in pipeline
+	outputTableNames := []string{}
+	formats := []string{}
+	compressions := []string{}
+	for _, result := range results {
+		outputTableNames = append(outputTableNames, result.Table)
+		formats = append(formats, result.Format)
+		compressions = append(compressions, result.Compression)
+	}
+	payload := map[string]interface{}{
+		"tables": strings.Join(outputTableNames, ","),
+		"config": confFileName,
+		"date":   timestamp,
+		// the format and COPY compression option of each table, in the same order as tables
+		"format":      strings.Join(formats, ","),
+		"compression": strings.Join(compressions, ","),
+	}
+	if upsert {
+		// the files of incremental tables only hold new and changed documents, so they must be
+		// merged into the table rather than replace it
+		payload["upsert"] = true
+		payload["truncate"] = false
+	}
+	return payload
+}
+
+// emitPayload emits the payload, exiting if that fails
+func emitPayload(run integrations, payload map[string]interface{}, results []*exporter.Result) {
+	if err := run.payload.emit(payload, results); err != nil {
+		log.ErrorD("emit-payload-error", logger.M{"error": err.Error()})
 		os.Exit(1)
 	}
-	uploadFile(manifestReader, flags.Bucket, manifestFilename)
+}
 
-	nextPayload.Current["tables"] = outputTableName
-	nextPayload.Current["config"] = confFileName
-	nextPayload.Current["date"] = timestamp
+// upsertTables reports whether the tables at keys are incremental, which their load has to
+// upsert. The payload's options apply to all of its tables, so incremental tables can't be
+// exported along with ones that aren't.
+func upsertTables(configYaml config.Config, keys []string) (bool, error) {
+	incremental := []string{}
+	for _, key := range keys {
+		if configYaml[key].Meta.IncrementalField != "" {
+			incremental = append(incremental, key)
+		}
+	}
+	if len(incremental) > 0 && len(incremental) < len(keys) {
+		return false, fmt.Errorf("incremental tables %s can't be exported in the same run as the others, which are loaded by replacing them", strings.Join(incremental, ","))
+	}
+	return len(incremental) > 0, nil
+}
 
-	analyticspipeline.PrintPayload(nextPayload)
+// restoreWatermarks moves back the watermarks of the tables that were exported by a run
+// that failed
+func restoreWatermarks(exporters []*exporter.Exporter, results []*exporter.Result) {
+	for i, result := range results {
+		if err := exporters[i].RestoreWatermark(result); err != nil {
+			log.ErrorD("restore-watermark-error", logger.M{"table": result.Table, "error": err.Error()})
+		}
+	}
 }
 
-// getRegionForBucket looks up the region name for the given bucket
-func getRegionForBucket(name string) (string, error) {
-	// Any region will work for the region lookup, but the request MUST use
-	// PathStyle
-	config := aws.NewConfig().WithRegion("us-west-1").WithS3ForcePathStyle(true)
-	session := session.New()
-	client := s3.New(session, config)
-	params := s3.GetBucketLocationInput{
-		Bucket: aws.String(name),
-	}
-	resp, err := client.GetBucketLocation(&params)
-	if err != nil {
-		return "", fmt.Errorf("Failed to get location for bucket '%s', %s", name, err)
+// exportTables runs the exports with a pool of concurrency workers. The results are in the
+// same order as the exporters. The first export to fail aborts the others, and its error
+// is returned along with the results of the exports that finished, nil for the others.
+func exportTables(ctx context.Context, exporters []*exporter.Exporter, concurrency int) ([]*exporter.Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]*exporter.Result, len(exporters))
+	var firstErr error
+	var errMutex sync.Mutex
+	indexes := make(chan int)
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer waitGroup.Done()
+			for i := range indexes {
+				result, err := exporters[i].Export(ctx)
+				if err != nil {
+					errMutex.Lock()
+					// the exports aborted because of the failure don't hide it
+					if firstErr == nil || errors.Is(firstErr, exporter.ErrAborted) {
+						firstErr = err
+					}
+					errMutex.Unlock()
+					cancel()
+					continue
+				}
+				results[i] = result
+			}
+		}()
+	}
+	for i := range exporters {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+		}
 	}
-	if resp.LocationConstraint == nil {
-		// "US Standard", returns an empty region. So return any region in the US
-		return "us-east-1", nil
+	close(indexes)
+	waitGroup.Wait()
+	if ctx.Err() != nil && firstErr == nil {
+		firstErr = exporter.ErrAborted
 	}
-	return *resp.LocationConstraint, nil
+	return results, firstErr
 }
@@ -3,26 +3,129 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
 	"testing"
 
+	"github.com/Clever/mongo-to-s3/config"
+	"github.com/Clever/mongo-to-s3/exporter"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestCreateManifest(t *testing.T) {
-	reader, err := createManifest("bucket", []string{"foo", "bar"})
+func TestParseEncryption(t *testing.T) {
+	e, err := parseEncryption("aes256", "", "", false)
 	assert.NoError(t, err)
-	expectedManifest := &Manifest{
-		EntryArray{
-			map[string]interface{}{"url": "s3://bucket/foo", "mandatory": true},
-			map[string]interface{}{"url": "s3://bucket/bar", "mandatory": true},
-		},
+	assert.Equal(t, "aes256", e.Type)
+
+	e, err = parseEncryption("kms", "alias/student-data", "app=mongo-to-s3,team=ip", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "alias/student-data", e.KMSKeyID)
+	assert.Equal(t, map[string]string{"app": "mongo-to-s3", "team": "ip"}, e.Context)
+	assert.True(t, e.BucketKey)
+
+	_, err = parseEncryption("kms", "", "app", false)
+	assert.Error(t, err)
+	_, err = parseEncryption("aes256", "alias/student-data", "", false)
+	assert.Error(t, err)
+}
+
+func TestUpsertTables(t *testing.T) {
+	configYaml := config.Config{
+		"students": {Destination: "students", Meta: config.Meta{IncrementalField: "updated_at"}},
+		"sections": {Destination: "sections", Meta: config.Meta{IncrementalField: "_id"}},
+		"schools":  {Destination: "schools"},
 	}
+	upsert, err := upsertTables(configYaml, []string{"sections", "students"})
+	assert.NoError(t, err)
+	assert.True(t, upsert)
+	upsert, err = upsertTables(configYaml, []string{"schools"})
+	assert.NoError(t, err)
+	assert.False(t, upsert)
+	_, err = upsertTables(configYaml, []string{"schools", "students"})
+	assert.Error(t, err)
+}
+
+func TestNextPayload(t *testing.T) {
+	results := []*exporter.Result{
+		{Table: "students", Format: "json", Compression: "GZIP"},
+		{Table: "sections", Format: "parquet"},
+		{Table: "schools", Format: "csv", Compression: "ZSTD"},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"tables":      "students,sections,schools",
+		"config":      "s3://bucket/mongo_raw/il/il_2016-01-27T21:00:00Z.yml",
+		"date":        "2016-01-27T21:00:00Z",
+		"format":      "json,parquet,csv",
+		"compression": "GZIP,,ZSTD",
+	}, nextPayload(results, "s3://bucket/mongo_raw/il/il_2016-01-27T21:00:00Z.yml", "2016-01-27T21:00:00Z", false))
 
-	bytes, err := ioutil.ReadAll(reader)
+	payload := nextPayload(results[:1], "", "", true)
+	assert.Equal(t, true, payload["upsert"])
+	assert.Equal(t, false, payload["truncate"])
+}
+
+func TestSourceFlags(t *testing.T) {
+	file, err := ioutil.TempFile("", "mongo-to-s3-config")
 	assert.NoError(t, err)
-	manifest := &Manifest{}
-	err = json.Unmarshal(bytes, manifest)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`students:
+  dest: students
+  columns:
+    - source: _id
+      dest: id
+      type: varchar(24)
+      primarykey: true
+      notnull: true
+`)
 	assert.NoError(t, err)
-	// check that the manifest entries match
-	assert.Equal(t, expectedManifest.Entries, manifest.Entries)
+	assert.NoError(t, file.Close())
+
+	source := sourceFlags{configFile: file.Name(), url: "mongodb://localhost/school"}
+	c, err := source.resolve()
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb://localhost/school", c.URL)
+	table, err := source.table(c, "students")
+	assert.NoError(t, err)
+	assert.Equal(t, "students", table.Destination)
+	_, err = source.table(c, "teachers")
+	assert.Error(t, err)
+
+	assert.NoError(t, validateCommand([]string{"-file", file.Name()}))
+	assert.Error(t, validateCommand([]string{"-file", file.Name(), "-keyLayout", "{{.Nope}}"}))
+	assert.Error(t, validateCommand([]string{}))
+}
+
+func TestStandalone(t *testing.T) {
+	assert.True(t, standaloneRequested([]string{"-config", "il", "-standalone"}))
+	assert.False(t, standaloneRequested([]string{"-config", "il"}))
+
+	output, err := ioutil.TempFile("", "mongo-to-s3-result")
+	assert.NoError(t, err)
+	assert.NoError(t, output.Close())
+	defer os.Remove(output.Name())
+
+	run := standaloneIntegrations([]string{"-standalone", "-config", "il", "-allTables", "-output", output.Name()})
+	flags := struct {
+		Name      string `config:"config"`
+		Bucket    string `config:"bucket"`
+		AllTables bool   `config:"allTables"`
+	}{Bucket: "file:///tmp/exports"}
+	assert.NoError(t, run.flags.parse(&flags))
+	assert.Equal(t, "il", flags.Name)
+	assert.Equal(t, "file:///tmp/exports", flags.Bucket)
+	assert.True(t, flags.AllTables)
+	assert.False(t, run.freshness.isFresh(config.Table{Destination: "students"}))
+
+	results := []*exporter.Result{{Table: "students", Rows: 2, Manifests: []string{"file:///tmp/exports/students/manifest.json"}}}
+	assert.NoError(t, run.payload.emit(map[string]interface{}{"tables": "students"}, results))
+	data, err := ioutil.ReadFile(output.Name())
+	assert.NoError(t, err)
+	var written struct {
+		Tables  string            `json:"tables"`
+		Results []exporter.Result `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &written))
+	assert.Equal(t, "students", written.Tables)
+	assert.Equal(t, []exporter.Result{*results[0]}, written.Results)
+
+	assert.Error(t, standaloneIntegrations([]string{"-nope"}).flags.parse(&flags))
 }